@@ -1,102 +1,1049 @@
 package main
 
 import (
+	"compress/gzip"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
+	"github.com/caarlos0/env/v11"
 	"github.com/infastin/gorack/validation"
 	"github.com/infastin/gorack/validation/is/str"
 	"github.com/infastin/gorack/xtypes"
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/labels"
+	k8svalidation "k8s.io/apimachinery/pkg/util/validation"
 )
 
+// ByteSize is a number of bytes, which can be specified
+// with a decimal (KB, MB, GB, TB) or binary (KiB, MiB, GiB, TiB) unit suffix.
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+
+	num := strings.TrimRightFunc(s, func(r rune) bool {
+		return !unicode.IsDigit(r)
+	})
+	unit := strings.TrimSpace(s[len(num):])
+
+	var multiplier int64
+	switch strings.ToLower(unit) {
+	case "", "b":
+		multiplier = 1
+	case "kb":
+		multiplier = 1000
+	case "mb":
+		multiplier = 1000 * 1000
+	case "gb":
+		multiplier = 1000 * 1000 * 1000
+	case "tb":
+		multiplier = 1000 * 1000 * 1000 * 1000
+	case "kib":
+		multiplier = 1 << 10
+	case "mib":
+		multiplier = 1 << 20
+	case "gib":
+		multiplier = 1 << 30
+	case "tib":
+		multiplier = 1 << 40
+	default:
+		return fmt.Errorf("unknown unit %q, must be one of B, KB, MB, GB, TB, KiB, MiB, GiB, TiB", unit)
+	}
+
+	value, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return errors.New("must be an integer with an optional unit suffix")
+	}
+
+	*b = ByteSize(value * multiplier)
+	return nil
+}
+
 type S3Config struct {
-	Endpoint        string          `env:"ENDPOINT"`
-	Region          string          `env:"REGION"`
-	AccessKeyID     string          `env:"ACCESS_KEY_ID"`
-	SecretAccessKey string          `env:"SECRET_ACCESS_KEY"`
-	Bucket          string          `env:"BUCKET"`
-	StorageClass    string          `env:"STORAGE_CLASS"`
-	Unsecure        bool            `env:"UNSECURE"`
-	ArchiveLifetime xtypes.Duration `env:"ARCHIVE_LIFETIME"`
+	Endpoint            string            `env:"ENDPOINT" yaml:"endpoint"`
+	Region              string            `env:"REGION" yaml:"region"`
+	CredentialsMode     string            `env:"CREDENTIALS_MODE" envDefault:"static" yaml:"credentials_mode"`
+	AccessKeyID         string            `env:"ACCESS_KEY_ID" yaml:"access_key_id"`
+	AccessKeyIDFile     string            `env:"ACCESS_KEY_ID_FILE,file" yaml:"access_key_id_file"`
+	SecretAccessKey     string            `env:"SECRET_ACCESS_KEY" yaml:"secret_access_key"`
+	SecretAccessKeyFile string            `env:"SECRET_ACCESS_KEY_FILE,file" yaml:"secret_access_key_file"`
+	Bucket              string            `env:"BUCKET" yaml:"bucket"`
+	StorageClass        string            `env:"STORAGE_CLASS" yaml:"storage_class"`
+	CustomStorageClass  bool              `env:"CUSTOM_STORAGE_CLASS" yaml:"custom_storage_class"`
+	Unsecure            bool              `env:"UNSECURE" yaml:"unsecure"`
+	ArchiveLifetime     xtypes.Duration   `env:"ARCHIVE_LIFETIME" yaml:"archive_lifetime"`
+	Checksum            bool              `env:"CHECKSUM" yaml:"checksum"`
+	RetentionDays       int               `env:"RETENTION_DAYS" yaml:"retention_days"`
+	RetentionCount      int               `env:"RETENTION_COUNT" yaml:"retention_count"`
+	KeyPrefix           string            `env:"KEY_PREFIX" yaml:"key_prefix"`
+	SSE                 string            `env:"SSE" yaml:"sse"`
+	SSEKMSKeyID         string            `env:"SSE_KMS_KEY_ID" yaml:"sse_kms_key_id"`
+	PartSize            ByteSize          `env:"PART_SIZE" yaml:"part_size"`
+	NumThreads          int               `env:"NUM_THREADS" yaml:"num_threads"`
+	ProgressInterval    xtypes.Duration   `env:"PROGRESS_INTERVAL" envDefault:"10s" yaml:"progress_interval"`
+	Timeout             xtypes.Duration   `env:"TIMEOUT" yaml:"timeout"`
+	MaxBandwidth        ByteSize          `env:"MAX_BANDWIDTH" yaml:"max_bandwidth"`
+	PresignExpiry       xtypes.Duration   `env:"PRESIGN_EXPIRY" yaml:"presign_expiry"`
+	CACert              string            `env:"CA_CERT" yaml:"ca_cert"`
+	InsecureSkipVerify  bool              `env:"INSECURE_SKIP_VERIFY" yaml:"insecure_skip_verify"`
+	CreateBucket        bool              `env:"CREATE_BUCKET" yaml:"create_bucket"`
+	LatestKey           string            `env:"LATEST_KEY" yaml:"latest_key"`
+	ContentType         string            `env:"CONTENT_TYPE" yaml:"content_type"`
+	Metadata            map[string]string `env:"METADATA" envKeyValSeparator:"=" yaml:"metadata"`
+	LockMode            string            `env:"LOCK_MODE" yaml:"lock_mode"`
+	LockDays            int               `env:"LOCK_DAYS" yaml:"lock_days"`
 }
 
+// Storage classes of AWS S3 and of the S3-compatible APIs of other providers.
+// Unknown classes are silently replaced with STANDARD by some of them, so typos are caught early.
+var knownStorageClasses = []string{
+	"STANDARD",
+	"REDUCED_REDUNDANCY",
+	"STANDARD_IA",
+	"ONEZONE_IA",
+	"INTELLIGENT_TIERING",
+	"GLACIER",
+	"GLACIER_IR",
+	"DEEP_ARCHIVE",
+	"OUTPOSTS",
+	"EXPRESS_ONEZONE",
+	"NEARLINE", // Google Cloud Storage
+	"COLDLINE", // Google Cloud Storage
+	"ARCHIVE",  // Google Cloud Storage
+	"COLD",     // Yandex Object Storage
+}
+
+// S3 doesn't accept presigned URLs valid for longer than a week.
+const maxPresignExpiry = xtypes.Duration(7 * 24 * time.Hour)
+
+// Matches valid names of user metadata, which are sent as x-amz-meta-NAME headers.
+var metadataKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*$`)
+
+// Matches placeholders of key prefixes and name templates.
+var placeholderRegexp = regexp.MustCompile(`\{([^{}]*)\}`)
+
 func (c *S3Config) Validate() error {
+	validKeyPrefix := func(s string) error {
+		for _, match := range placeholderRegexp.FindAllStringSubmatch(s, -1) {
+			switch match[1] {
+			case "namespace", "resource", "year", "month", "day":
+			default:
+				return fmt.Errorf("unknown placeholder %s, must be one of {namespace}, {resource}, {year}, {month}, {day}", match[0])
+			}
+		}
+		return nil
+	}
+	validSSE := func(s string) error {
+		switch s {
+		case "", "none", "s3", "kms":
+		default:
+			return errors.New("must be one of none, s3, kms")
+		}
+		return nil
+	}
+	validCredentialsMode := func(s string) error {
+		switch s {
+		case "static", "iam", "env", "chain":
+		default:
+			return errors.New("must be one of static, iam, env, chain")
+		}
+		return nil
+	}
+	validCACert := func(s string) error {
+		_, err := c.CACertPool()
+		return err
+	}
+	validMetadata := func(metadata *map[string]string) error {
+		for key := range *metadata {
+			if !metadataKeyRegexp.MatchString(key) {
+				return fmt.Errorf("key %q must consist of letters, digits and dashes", key)
+			}
+			if slices.ContainsFunc(reservedMetadataKeys, func(reserved string) bool {
+				return strings.EqualFold(key, reserved)
+			}) {
+				return fmt.Errorf("key %q is set by the backup itself", key)
+			}
+		}
+		return nil
+	}
+	validLockMode := func(s string) error {
+		switch s {
+		case "", "GOVERNANCE", "COMPLIANCE":
+		default:
+			return errors.New("must be one of GOVERNANCE, COMPLIANCE")
+		}
+		return nil
+	}
+	// Objects would be locked for no time otherwise.
+	validLockDays := func(days *int) error {
+		switch {
+		case c.LockMode != "" && *days == 0:
+			return errors.New("is required by lock_mode")
+		case c.LockMode == "" && *days != 0:
+			return errors.New("requires lock_mode")
+		}
+		return nil
+	}
+	validStorageClass := func(s string) error {
+		if !slices.Contains(knownStorageClasses, s) {
+			return fmt.Errorf("must be one of %s, set custom_storage_class to use another one", strings.Join(knownStorageClasses, ", "))
+		}
+		return nil
+	}
+	validPartSize := func(size *ByteSize) error {
+		if *size != 0 && (*size < 5<<20 || *size > 5<<30) {
+			return errors.New("must be between 5MiB and 5GiB")
+		}
+		return nil
+	}
 	return validation.All(
 		validation.String(c.Endpoint, "endpoint").If(c.Endpoint != "").With(isstr.URL).EndIf(),
-		validation.String(c.AccessKeyID, "access_key_id").Required(true),
-		validation.String(c.SecretAccessKey, "secret_access_key").Required(true),
+		validation.String(c.CredentialsMode, "credentials_mode").With(validCredentialsMode),
+		validation.String(c.AccessKeyID, "access_key_id").Required(c.CredentialsMode == "static"),
+		validation.String(c.SecretAccessKey, "secret_access_key").Required(c.CredentialsMode == "static"),
 		validation.String(c.Bucket, "bucket").Required(true),
+		validation.String(c.StorageClass, "storage_class").
+			If(c.StorageClass != "" && !c.CustomStorageClass).With(validStorageClass).EndIf(),
 		validation.Number(c.ArchiveLifetime, "archive_lifetime").GreaterEqual(0),
+		validation.Number(c.RetentionDays, "retention_days").GreaterEqual(0),
+		validation.Number(c.RetentionCount, "retention_count").GreaterEqual(0),
+		validation.String(c.KeyPrefix, "key_prefix").With(validKeyPrefix),
+		validation.String(c.SSE, "sse").With(validSSE),
+		validation.String(c.SSEKMSKeyID, "sse_kms_key_id").Required(c.SSE == "kms"),
+		validation.Ptr(&c.PartSize, "part_size").With(validPartSize),
+		validation.Number(c.NumThreads, "num_threads").GreaterEqual(0),
+		validation.Number(c.ProgressInterval, "progress_interval").GreaterEqual(0),
+		validation.Number(c.Timeout, "timeout").GreaterEqual(0),
+		validation.Number(c.MaxBandwidth, "max_bandwidth").GreaterEqual(0),
+		validation.Number(c.PresignExpiry, "presign_expiry").GreaterEqual(0).LessEqual(maxPresignExpiry),
+		validation.String(c.CACert, "ca_cert").If(c.CACert != "").With(validCACert).EndIf(),
+		validation.Ptr(&c.Metadata, "metadata").With(validMetadata),
+		validation.String(c.LockMode, "lock_mode").With(validLockMode),
+		validation.Number(c.LockDays, "lock_days").GreaterEqual(0),
+		validation.Ptr(&c.LockDays, "lock_days").With(validLockDays),
+	)
+}
+
+// UnmarshalYAML sets the defaults before decoding,
+// since mirrors from the file don't have them otherwise.
+func (c *S3Config) UnmarshalYAML(node *yaml.Node) error {
+	if err := env.ParseWithOptions(c, env.Options{Environment: map[string]string{}}); err != nil {
+		return err
+	}
+	type plain S3Config
+	return node.Decode((*plain)(c))
+}
+
+// Normalize reads AccessKeyID and SecretAccessKey from their files.
+func (c *S3Config) Normalize() {
+	if c.AccessKeyIDFile != "" {
+		c.AccessKeyID = strings.TrimRight(c.AccessKeyIDFile, "\r\n")
+		c.AccessKeyIDFile = ""
+	}
+	if c.SecretAccessKeyFile != "" {
+		c.SecretAccessKey = strings.TrimRight(c.SecretAccessKeyFile, "\r\n")
+		c.SecretAccessKeyFile = ""
+	}
+}
+
+// AWS S3 endpoint, the client resolves the regional one by itself.
+const awsS3Endpoint = "s3.amazonaws.com"
+
+// EndpointHost returns the host of the endpoint and whether TLS should be used.
+// Endpoint can be specified either as a host or as a URL,
+// in which case its scheme takes precedence over Unsecure.
+// Empty endpoint means AWS S3.
+func (c *S3Config) EndpointHost() (host string, secure bool) {
+	if c.Endpoint == "" {
+		return awsS3Endpoint, !c.Unsecure
+	}
+	if u, err := url.Parse(c.Endpoint); err == nil && u.Host != "" {
+		return u.Host, u.Scheme != "http"
+	}
+	return c.Endpoint, !c.Unsecure
+}
+
+// CACertPool returns the system certificate pool with CACert added to it.
+// CACert can be specified either as a path to a PEM file or as PEM itself.
+func (c *S3Config) CACertPool() (pool *x509.CertPool, err error) {
+	data := []byte(c.CACert)
+	if !strings.HasPrefix(strings.TrimSpace(c.CACert), "-----BEGIN") {
+		data, err = os.ReadFile(c.CACert)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pool, err = x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates found")
+	}
+
+	return pool, nil
+}
+
+type FSConfig struct {
+	Path string `env:"PATH" yaml:"path"`
+}
+
+func (c *FSConfig) Validate() error {
+	validDir := func(s string) error {
+		info, err := os.Stat(s)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return errors.New("must be a directory")
+		}
+		return nil
+	}
+	return validation.All(
+		validation.String(c.Path, "path").Required(true).With(validDir),
 	)
 }
 
 type TelegramConfig struct {
-	BotToken string `env:"BOT_TOKEN"`
-	ChatID   int64  `env:"CHAT_ID"`
+	BotToken        string `env:"BOT_TOKEN" yaml:"bot_token"`
+	BotTokenFile    string `env:"BOT_TOKEN_FILE,file" yaml:"bot_token_file"`
+	ChatID          int64  `env:"CHAT_ID" yaml:"chat_id"`
+	LogThreshold    int    `env:"LOG_THRESHOLD" envDefault:"4096" yaml:"log_threshold"`
+	Template        string `env:"TEMPLATE" yaml:"template"`
+	ParseMode       string `env:"PARSE_MODE" envDefault:"HTML" yaml:"parse_mode"`
+	Retries         int    `env:"RETRIES" envDefault:"2" yaml:"retries"`
+	FailureExitCode int    `env:"FAILURE_EXIT_CODE" envDefault:"3" yaml:"failure_exit_code"`
 }
 
 func (c *TelegramConfig) Validate() error {
 	if c.BotToken == "" {
 		return nil
 	}
+	validParseMode := func(s string) error {
+		switch s {
+		case "HTML", "MarkdownV2", "none":
+		default:
+			return errors.New("must be one of HTML, MarkdownV2, none")
+		}
+		return nil
+	}
+	validTemplate := func(s string) error {
+		_, err := parseTelegramTemplate(s, c.ParseMode)
+		return err
+	}
+	validFailureExitCode := func(code *int) error {
+		if *code == 1 {
+			return errors.New("must differ from 1, which is used for failures")
+		}
+		return nil
+	}
 	return validation.All(
 		validation.String(c.BotToken, "bot_token").Required(true),
 		validation.Number(c.ChatID, "chat_id").Required(true),
+		validation.Number(c.LogThreshold, "log_threshold").Greater(0).LessEqual(telegramMessageLimit),
+		validation.String(c.Template, "template").If(c.Template != "").With(validTemplate).EndIf(),
+		validation.String(c.ParseMode, "parse_mode").With(validParseMode),
+		validation.Number(c.Retries, "retries").GreaterEqual(0),
+		validation.Number(c.FailureExitCode, "failure_exit_code").GreaterEqual(0).LessEqual(255),
+		validation.Ptr(&c.FailureExitCode, "failure_exit_code").With(validFailureExitCode),
+	)
+}
+
+// Normalize reads BotToken from BotTokenFile.
+func (c *TelegramConfig) Normalize() {
+	if c.BotTokenFile != "" {
+		c.BotToken = strings.TrimRight(c.BotTokenFile, "\r\n")
+		c.BotTokenFile = ""
+	}
+}
+
+type SlackConfig struct {
+	WebhookURL string `env:"WEBHOOK_URL" yaml:"webhook_url"`
+	Channel    string `env:"CHANNEL" yaml:"channel"`
+}
+
+func (c *SlackConfig) Validate() error {
+	return validation.All(
+		validation.String(c.WebhookURL, "webhook_url").If(c.WebhookURL != "").With(isstr.URL).EndIf(),
+	)
+}
+
+type WebhookConfig struct {
+	URL string `env:"URL" yaml:"url"`
+}
+
+func (c *WebhookConfig) Validate() error {
+	return validation.All(
+		validation.String(c.URL, "url").If(c.URL != "").With(isstr.URL).EndIf(),
+	)
+}
+
+type MetricsConfig struct {
+	Addr           string `env:"ADDR" yaml:"addr"`
+	PushgatewayURL string `env:"PUSHGATEWAY_URL" yaml:"pushgateway_url"`
+}
+
+func (c *MetricsConfig) Validate() error {
+	return validation.All(
+		validation.String(c.PushgatewayURL, "pushgateway_url").If(c.PushgatewayURL != "").With(isstr.URL).EndIf(),
+	)
+}
+
+type HealthConfig struct {
+	Addr            string          `env:"ADDR" yaml:"addr"`
+	ProgressTimeout xtypes.Duration `env:"PROGRESS_TIMEOUT" envDefault:"10m" yaml:"progress_timeout"`
+}
+
+func (c *HealthConfig) Validate() error {
+	return validation.All(
+		validation.Number(c.ProgressTimeout, "progress_timeout").Greater(0),
+	)
+}
+
+type SnapshotConfig struct {
+	PVC     string          `env:"PVC" yaml:"pvc"`
+	Class   string          `env:"CLASS" yaml:"class"`
+	Timeout xtypes.Duration `env:"TIMEOUT" envDefault:"5m" yaml:"timeout"`
+}
+
+func (c *SnapshotConfig) Validate() error {
+	if c.PVC == "" {
+		return nil
+	}
+	return validation.All(
+		validation.Number(c.Timeout, "timeout").Greater(0),
+	)
+}
+
+type LockConfig struct {
+	Enabled  bool            `env:"ENABLED" yaml:"enabled"`
+	Prefix   string          `env:"PREFIX" envDefault:"k8s-backup" yaml:"prefix"`
+	Duration xtypes.Duration `env:"DURATION" envDefault:"1m" yaml:"duration"`
+}
+
+func (c *LockConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	// The name of the lease is the prefix followed by a hash.
+	validPrefix := func(s string) error {
+		if errs := k8svalidation.IsDNS1123Label(s); len(errs) != 0 {
+			return errors.New(strings.Join(errs, ", "))
+		}
+		return nil
+	}
+	return validation.All(
+		validation.String(c.Prefix, "prefix").Required(true).With(validPrefix),
+		// Leases are measured in seconds.
+		validation.Number(c.Duration, "duration").GreaterEqual(xtypes.Duration(time.Second)),
 	)
 }
 
 type ResourceConfig struct {
-	ID        string `env:"ID"`
-	Namespace string `env:"NAMESPACE"`
-	Wait      bool   `env:"WAIT"`
+	IDs            []string        `env:"ID" yaml:"id"`
+	APIGroup       string          `env:"API_GROUP" yaml:"api_group"`
+	APIVersion     string          `env:"API_VERSION" envDefault:"v1" yaml:"api_version"`
+	Namespace      string          `env:"NAMESPACE" yaml:"namespace"`
+	Wait           bool            `env:"WAIT" yaml:"wait"`
+	WaitTimeout    xtypes.Duration `env:"WAIT_TIMEOUT" envDefault:"2m" yaml:"wait_timeout"`
+	PollInterval   xtypes.Duration `env:"POLL_INTERVAL" envDefault:"5s" yaml:"poll_interval"`
+	SkipScale      bool            `env:"SKIP_SCALE" yaml:"skip_scale"`
+	RespectPDB     bool            `env:"RESPECT_PDB" yaml:"respect_pdb"`
+	ScaleUpRetries int             `env:"SCALEUP_RETRIES" envDefault:"3" yaml:"scaleup_retries"`
+	ScaleTarget    int             `env:"SCALE_TARGET" yaml:"scale_target"`
+	ScaleMethod    string          `env:"SCALE_METHOD" envDefault:"update" yaml:"scale_method"`
+	HandleHPA      string          `env:"HANDLE_HPA" envDefault:"ignore" yaml:"handle_hpa"`
+	Events         bool            `env:"EVENTS" yaml:"events"`
+	Annotate       bool            `env:"ANNOTATE" yaml:"annotate"`
+	Selector       string          `env:"SELECTOR" yaml:"selector"`
+	SelectorType   string          `env:"SELECTOR_TYPE" envDefault:"deployments" yaml:"selector_type"`
 }
 
 func (c *ResourceConfig) Validate() error {
+	validType := func(s string) error {
+		// Custom resources are specified by their plural names, e.g. postgresclusters.
+		if c.APIGroup != "" {
+			if errs := k8svalidation.IsDNS1123Label(s); len(errs) != 0 {
+				return errors.New(errs[0])
+			}
+			return nil
+		}
+		switch s {
+		case "deployment", "deployments",
+			"statefulset", "statefulsets",
+			"replicaset", "replicasets",
+			"daemonset", "daemonsets",
+			"cronjob", "cronjobs":
+			return nil
+		default:
+			return errors.New("must be deployment(s), statefulset(s), replicaset(s), daemonset(s) or cronjob(s)")
+		}
+	}
 	validID := func(s string) error {
 		parts := strings.SplitN(s, "/", 2)
 		if len(parts) == 1 {
 			return errors.New("must be TYPE/NAME")
 		}
-		switch parts[0] {
-		case "deployment", "deployments",
-			"statefulset", "statefulsets",
-			"replicaset", "replicasets":
-		default:
-			return errors.New("TYPE must be deployment(s), statefulset(s) or replicaset(s)")
+		if err := validType(parts[0]); err != nil {
+			return fmt.Errorf("TYPE %w", err)
 		}
 		if len(parts[1]) == 0 {
 			return errors.New("NAME must not be empty")
 		}
 		return nil
 	}
+	validScaleMethod := func(s string) error {
+		switch s {
+		case "update", "merge":
+		case "strategic":
+			// Custom resources don't support strategic merge patches.
+			if c.APIGroup != "" {
+				return errors.New("strategic is not supported with api_group")
+			}
+		default:
+			return errors.New("must be one of update, merge, strategic")
+		}
+		return nil
+	}
+	validAPIGroup := func(s string) error {
+		if errs := k8svalidation.IsDNS1123Subdomain(s); len(errs) != 0 {
+			return errors.New(errs[0])
+		}
+		return nil
+	}
+	validHandleHPA := func(s string) error {
+		switch s {
+		case "ignore", "warn", "refuse", "pause":
+		default:
+			return errors.New("must be one of ignore, warn, refuse, pause")
+		}
+		return nil
+	}
+	validSelector := func(s string) error {
+		_, err := labels.Parse(s)
+		return err
+	}
+	validIDs := func(ids *[]string) error {
+		// Resources can be selected by labels instead.
+		if len(*ids) == 0 && c.Selector == "" {
+			return errors.New("must not be empty")
+		}
+		seen := make(map[string]struct{}, len(*ids))
+		for _, id := range *ids {
+			if err := validID(id); err != nil {
+				return fmt.Errorf("%s: %w", id, err)
+			}
+			if _, ok := seen[id]; ok {
+				return fmt.Errorf("%s: must not be specified twice", id)
+			}
+			seen[id] = struct{}{}
+		}
+		return nil
+	}
 	return validation.All(
-		validation.String(c.ID, "id").Required(true).With(validID),
+		validation.Ptr(&c.IDs, "id").With(validIDs),
+		validation.String(c.APIGroup, "api_group").If(c.APIGroup != "").With(validAPIGroup).EndIf(),
+		validation.String(c.APIVersion, "api_version").If(c.APIGroup != "").Required(true).EndIf(),
+		validation.String(c.Selector, "selector").With(validSelector),
+		validation.String(c.SelectorType, "selector_type").If(c.Selector != "").With(validType).EndIf(),
 		validation.String(c.Namespace, "namespace").Required(true),
+		validation.Number(c.WaitTimeout, "wait_timeout").Greater(0),
+		validation.Number(c.PollInterval, "poll_interval").Greater(0),
+		validation.Number(c.ScaleUpRetries, "scaleup_retries").GreaterEqual(0),
+		validation.Number(c.ScaleTarget, "scale_target").GreaterEqual(0),
+		validation.String(c.ScaleMethod, "scale_method").With(validScaleMethod),
+		validation.String(c.HandleHPA, "handle_hpa").With(validHandleHPA),
 	)
 }
 
+// File with the namespace of the pod, which is mounted when running in a cluster.
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Normalize sets Namespace to the pod's own namespace, if it's empty.
+func (c *ResourceConfig) Normalize() {
+	if c.Namespace != "" {
+		return
+	}
+	if data, err := os.ReadFile(serviceAccountNamespaceFile); err == nil {
+		c.Namespace = strings.TrimSpace(string(data))
+	}
+}
+
+type CompressionLevel int
+
+func (l *CompressionLevel) UnmarshalText(text []byte) error {
+	switch s := string(text); s {
+	case "default":
+		*l = gzip.DefaultCompression
+	case "none":
+		*l = gzip.NoCompression
+	case "fast":
+		*l = gzip.BestSpeed
+	case "best":
+		*l = gzip.BestCompression
+	default:
+		level, err := strconv.Atoi(s)
+		if err != nil {
+			return errors.New("must be an integer or one of default, none, fast, best")
+		}
+		*l = CompressionLevel(level)
+	}
+	return nil
+}
+
 type BackupConfig struct {
-	Directory string `env:"DIRECTORY"`
+	Directory            string            `env:"DIRECTORY" yaml:"directory"`
+	Directories          []string          `env:"DIRECTORIES" yaml:"directories"`
+	Compress             bool              `env:"COMPRESS" envDefault:"true" yaml:"compress"`
+	CompressionLevel     CompressionLevel  `env:"COMPRESSION_LEVEL" envDefault:"default" yaml:"compression_level"`
+	ParallelCompression  bool              `env:"PARALLEL_COMPRESSION" yaml:"parallel_compression"`
+	CompressionBlockSize ByteSize          `env:"COMPRESSION_BLOCK_SIZE" envDefault:"1MiB" yaml:"compression_block_size"`
+	CompressionWorkers   int               `env:"COMPRESSION_WORKERS" yaml:"compression_workers"`
+	Timeout              xtypes.Duration   `env:"TIMEOUT" envDefault:"3m" yaml:"timeout"`
+	PostScaleDelay       xtypes.Duration   `env:"POST_SCALE_DELAY" yaml:"post_scale_delay"`
+	MaxSize              ByteSize          `env:"MAX_SIZE" yaml:"max_size"`
+	Verify               bool              `env:"VERIFY" envDefault:"true" yaml:"verify"`
+	TempDir              string            `env:"TEMP_DIR" yaml:"temp_dir"`
+	EncryptionKey        string            `env:"ENCRYPTION_KEY" yaml:"encryption_key"`
+	EncryptionKeyFile    string            `env:"ENCRYPTION_KEY_FILE,file" yaml:"encryption_key_file"`
+	Exclude              []string          `env:"EXCLUDE" yaml:"exclude"`
+	Include              []string          `env:"INCLUDE" yaml:"include"`
+	FollowSymlinks       bool              `env:"FOLLOW_SYMLINKS" yaml:"follow_symlinks"`
+	AllowEmpty           bool              `env:"ALLOW_EMPTY" yaml:"allow_empty"`
+	Verbose              bool              `env:"VERBOSE" yaml:"verbose"`
+	Sparse               bool              `env:"SPARSE" yaml:"sparse"`
+	Stream               bool              `env:"STREAM" yaml:"stream"`
+	Mode                 string            `env:"MODE" envDefault:"full" yaml:"mode"`
+	FullInterval         int               `env:"FULL_INTERVAL" envDefault:"6" yaml:"full_interval"`
+	ChunkSize            ByteSize          `env:"CHUNK_SIZE" envDefault:"1MiB" yaml:"chunk_size"`
+	QuiesceMode          string            `env:"QUIESCE_MODE" envDefault:"scale" yaml:"quiesce_mode"`
+	Concurrency          int               `env:"CONCURRENCY" yaml:"concurrency"`
+	CheckFreeSpace       bool              `env:"CHECK_FREE_SPACE" envDefault:"true" yaml:"check_free_space"`
+	CopyFirst            bool              `env:"COPY_FIRST" yaml:"copy_first"`
+	StreamEntries        map[string]string `env:"STREAM_ENTRY" envSeparator:"\n" envKeyValSeparator:"=" yaml:"stream_entries"`
+	WarnUnchanged        bool              `env:"WARN_UNCHANGED" yaml:"warn_unchanged"`
+	UnchangedHistory     int               `env:"UNCHANGED_HISTORY" envDefault:"10" yaml:"unchanged_history"`
+	NameTemplate         string            `env:"NAME_TEMPLATE" envDefault:"backup-{date}" yaml:"name_template"`
+	Timezone             string            `env:"TIMEZONE" yaml:"timezone"`
+	IncludeManifest      bool              `env:"INCLUDE_MANIFEST" yaml:"include_manifest"`
+	IncludeConfigs       bool              `env:"INCLUDE_CONFIGS" yaml:"include_configs"`
+	IncludeInfo          bool              `env:"INCLUDE_INFO" yaml:"include_info"`
 }
 
 func (c *BackupConfig) Validate() error {
+	validDirectories := func(dirs *[]string) error {
+		if len(*dirs) == 0 {
+			return errors.New("must not be empty")
+		}
+		names := make(map[string]struct{}, len(*dirs))
+		for _, dir := range *dirs {
+			if dir == "" {
+				return errors.New("must not contain empty entries")
+			}
+			name := filepath.Base(dir)
+			if _, ok := names[name]; ok {
+				return fmt.Errorf("must not contain directories with the same base name %q", name)
+			}
+			names[name] = struct{}{}
+		}
+		return nil
+	}
+	validPatterns := func(patterns *[]string) error {
+		for _, pattern := range *patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s: %w", pattern, err)
+			}
+		}
+		return nil
+	}
+	// The name is used for the temporary file and as the last part of the key.
+	validNameTemplate := func(s string) error {
+		if strings.Contains(s, "/") {
+			return errors.New("must not contain slashes")
+		}
+		for _, match := range placeholderRegexp.FindAllStringSubmatch(s, -1) {
+			name, _, hasFormat := strings.Cut(match[1], ":")
+			switch {
+			case name == "date":
+			case (name == "resource" || name == "namespace") && !hasFormat:
+			default:
+				return fmt.Errorf("unknown placeholder %s, must be one of {resource}, {namespace}, {date}, {date:FORMAT}", match[0])
+			}
+		}
+		return nil
+	}
+	validTimezone := func(s string) error {
+		_, err := time.LoadLocation(s)
+		return err
+	}
+	validIncludeConfigs := func(include *bool) error {
+		if *include && !c.IncludeManifest {
+			return errors.New("requires include_manifest to be true")
+		}
+		return nil
+	}
+	validMode := func(s string) error {
+		switch s {
+		case "full":
+		case "incremental":
+			// The index is built while archiving and uploaded after the archive.
+			if c.Stream {
+				return errors.New("incremental is not supported with stream")
+			}
+		case "dedup":
+			switch {
+			case c.Stream:
+				return errors.New("dedup is not supported with stream")
+			// Chunks would have to be encrypted separately, which is too slow with the key derivation.
+			case c.EncryptionKey != "":
+				return errors.New("dedup is not supported with encryption key")
+			}
+		default:
+			return errors.New("must be one of full, incremental, dedup")
+		}
+		return nil
+	}
+	// The checksum is stored in the metadata, which is sent before streaming.
+	validWarnUnchanged := func(warn *bool) error {
+		if *warn && c.Stream {
+			return errors.New("is not supported with stream")
+		}
+		return nil
+	}
+	validQuiesceMode := func(s string) error {
+		switch s {
+		case "scale":
+		case "fsfreeze":
+			// The file systems would stay frozen for the whole upload.
+			if c.Stream {
+				return errors.New("fsfreeze is not supported with stream")
+			}
+		default:
+			return errors.New("must be one of scale, fsfreeze")
+		}
+		return nil
+	}
+	// Resources backed up separately would back up the same data
+	// and overwrite and prune each other's archives otherwise.
+	validConcurrency := func(n *int) error {
+		if *n == 0 {
+			return nil
+		}
+		if !strings.Contains(c.NameTemplate, "{resource}") {
+			return errors.New("requires name_template to contain {resource}")
+		}
+		for _, dir := range c.Directories {
+			if !strings.Contains(dir, "{resource}") {
+				return fmt.Errorf("requires directories to contain {resource}, but %s doesn't", dir)
+			}
+		}
+		return nil
+	}
+	// Entries are added to the root of the archive.
+	validStreamEntries := func(entries *map[string]string) error {
+		for name, command := range *entries {
+			if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+				return fmt.Errorf("invalid entry name %q", name)
+			}
+			if command == "" {
+				return fmt.Errorf("%s: command must not be empty", name)
+			}
+		}
+		return nil
+	}
+	// Checks that a file can be created, so that archiving doesn't fail after scaling down.
+	validTempDir := func(s string) error {
+		file, err := os.CreateTemp(s, ".k8s-backup-*")
+		if err != nil {
+			return err
+		}
+		file.Close()
+		return os.Remove(file.Name())
+	}
 	return validation.All(
-		validation.String(c.Directory, "directory").Required(true),
+		validation.Ptr(&c.Directories, "directories").With(validDirectories),
+		validation.Ptr(&c.Exclude, "exclude").With(validPatterns),
+		validation.Ptr(&c.Include, "include").With(validPatterns),
+		validation.Number(c.CompressionLevel, "compression_level").
+			GreaterEqual(gzip.DefaultCompression).
+			LessEqual(gzip.BestCompression),
+		validation.Number(c.CompressionBlockSize, "compression_block_size").GreaterEqual(64*1024),
+		validation.Number(c.CompressionWorkers, "compression_workers").GreaterEqual(0),
+		validation.Number(c.Timeout, "timeout").Greater(0),
+		validation.Number(c.PostScaleDelay, "post_scale_delay").GreaterEqual(0),
+		validation.Number(c.MaxSize, "max_size").GreaterEqual(0),
+		validation.String(c.NameTemplate, "name_template").Required(true).With(validNameTemplate),
+		validation.String(c.Timezone, "timezone").If(c.Timezone != "").With(validTimezone).EndIf(),
+		validation.Ptr(&c.IncludeConfigs, "include_configs").With(validIncludeConfigs),
+		validation.String(c.TempDir, "temp_dir").If(c.TempDir != "").With(validTempDir).EndIf(),
+		validation.String(c.Mode, "mode").With(validMode),
+		validation.Number(c.FullInterval, "full_interval").GreaterEqual(0),
+		validation.Number(c.ChunkSize, "chunk_size").GreaterEqual(4*1024).LessEqual(64*1024*1024),
+		validation.String(c.QuiesceMode, "quiesce_mode").With(validQuiesceMode),
+		validation.Number(c.Concurrency, "concurrency").GreaterEqual(0),
+		validation.Ptr(&c.Concurrency, "concurrency").With(validConcurrency),
+		validation.Ptr(&c.StreamEntries, "stream_entries").With(validStreamEntries),
+		validation.Ptr(&c.WarnUnchanged, "warn_unchanged").With(validWarnUnchanged),
+		validation.Number(c.UnchangedHistory, "unchanged_history").GreaterEqual(1),
 	)
 }
 
+// TempDirectory returns the directory for the temporary archive file.
+func (c *BackupConfig) TempDirectory() string {
+	if c.TempDir != "" {
+		return c.TempDir
+	}
+	return os.TempDir()
+}
+
+// Normalize adds Directory to Directories,
+// so that the former can be used as an alias,
+// and reads EncryptionKey from EncryptionKeyFile.
+func (c *BackupConfig) Normalize() {
+	if c.Directory != "" {
+		c.Directories = append([]string{c.Directory}, c.Directories...)
+		c.Directory = ""
+	}
+	if c.EncryptionKeyFile != "" {
+		c.EncryptionKey = strings.TrimRight(c.EncryptionKeyFile, "\r\n")
+		c.EncryptionKeyFile = ""
+	}
+}
+
+type HookConfig struct {
+	PreCommand  string          `env:"PRE_COMMAND" yaml:"pre_command"`
+	PostCommand string          `env:"POST_COMMAND" yaml:"post_command"`
+	PreExec     string          `env:"PRE_EXEC" yaml:"pre_exec"`
+	PostExec    string          `env:"POST_EXEC" yaml:"post_exec"`
+	Pod         string          `env:"POD" yaml:"pod"`
+	PodSelector string          `env:"POD_SELECTOR" yaml:"pod_selector"`
+	Container   string          `env:"CONTAINER" yaml:"container"`
+	Timeout     xtypes.Duration `env:"TIMEOUT" envDefault:"1m" yaml:"timeout"`
+}
+
+func (c *HookConfig) Validate() error {
+	exec := c.PreExec != "" || c.PostExec != ""
+	return validation.All(
+		validation.String(c.PodSelector, "pod_selector").Required(exec && c.Pod == ""),
+		validation.Number(c.Timeout, "timeout").Greater(0),
+	)
+}
+
+type RestoreConfig struct {
+	Archive        string `env:"ARCHIVE" yaml:"archive"`
+	VerifyChecksum bool   `env:"VERIFY_CHECKSUM" envDefault:"true" yaml:"verify_checksum"`
+}
+
 type Config struct {
-	Resource ResourceConfig `envPrefix:"RESOURCE_"`
-	Backup   BackupConfig   `envPrefix:"BACKUP_"`
-	S3       S3Config       `envPrefix:"S3_"`
-	Telegram TelegramConfig `envPrefix:"TELEGRAM_"`
+	Mode            string          `env:"MODE" envDefault:"backup" yaml:"mode"`
+	DryRun          bool            `env:"DRY_RUN" yaml:"dry_run"`
+	ClusterName     string          `env:"CLUSTER_NAME" yaml:"cluster_name"`
+	NodeName        string          `env:"NODE_NAME" yaml:"node_name"`
+	Kubeconfig      string          `env:"KUBECONFIG" yaml:"kubeconfig"`
+	ScaleUpTimeout  xtypes.Duration `env:"SCALEUP_TIMEOUT" envDefault:"1m" yaml:"scaleup_timeout"`
+	K8sMaxRetries   int             `env:"K8S_MAX_RETRIES" envDefault:"3" yaml:"k8s_max_retries"`
+	WarningExitCode int             `env:"WARNING_EXIT_CODE" yaml:"warning_exit_code"`
+	ResultFile      string          `env:"RESULT_FILE" yaml:"result_file"`
+	Resource        ResourceConfig  `envPrefix:"RESOURCE_" yaml:"resource"`
+	Backup          BackupConfig    `envPrefix:"BACKUP_" yaml:"backup"`
+	DestType        string          `env:"DEST_TYPE" envDefault:"s3" yaml:"dest_type"`
+	FS              FSConfig        `envPrefix:"FS_" yaml:"fs"`
+	S3              S3Config        `envPrefix:"S3_" yaml:"s3"`
+	S3Mirrors       []S3Config      `envPrefix:"S3_MIRROR_" yaml:"s3_mirrors"`
+	Telegram        TelegramConfig  `envPrefix:"TELEGRAM_" yaml:"telegram"`
+	Slack           SlackConfig     `envPrefix:"SLACK_" yaml:"slack"`
+	Webhook         WebhookConfig   `envPrefix:"WEBHOOK_" yaml:"webhook"`
+	Metrics         MetricsConfig   `envPrefix:"METRICS_" yaml:"metrics"`
+	Health          HealthConfig    `envPrefix:"HEALTH_" yaml:"health"`
+	Restore         RestoreConfig   `envPrefix:"RESTORE_" yaml:"restore"`
+	Snapshot        SnapshotConfig  `envPrefix:"SNAPSHOT_" yaml:"snapshot"`
+	Hook            HookConfig      `envPrefix:"HOOK_" yaml:"hook"`
+	Lock            LockConfig      `envPrefix:"LOCK_" yaml:"lock"`
 }
 
 func (c *Config) Validate() error {
+	validMode := func(s string) error {
+		switch s {
+		case "backup", "restore":
+		default:
+			return errors.New("must be one of backup, restore")
+		}
+		return nil
+	}
+	// Pods are gone after scaling down, so there is nowhere to execute hooks in.
+	validExecHooks := func(h *HookConfig) error {
+		if (h.PreExec != "" || h.PostExec != "") && !c.Resource.SkipScale && c.Backup.QuiesceMode != "fsfreeze" {
+			return errors.New("exec hooks require resource skip_scale to be true or backup quiesce_mode to be fsfreeze")
+		}
+		return nil
+	}
+	// Copying is worth it only to scale the resources back up before archiving.
+	validCopyFirst := func(b *BackupConfig) error {
+		if b.CopyFirst && (c.Resource.SkipScale || b.QuiesceMode == "fsfreeze") {
+			return errors.New("copy_first requires the resources to be scaled down")
+		}
+		return nil
+	}
+	// Custom resources don't have a pod template to find the references in.
+	validIncludeConfigsCustom := func(b *BackupConfig) error {
+		if b.IncludeConfigs && c.Resource.APIGroup != "" {
+			return errors.New("include_configs is not supported with resource api_group")
+		}
+		return nil
+	}
+	// The same volume would be snapshotted for each resource.
+	validSnapshot := func(s *SnapshotConfig) error {
+		if s.PVC != "" && c.Backup.Concurrency != 0 {
+			return errors.New("pvc is not supported with backup concurrency")
+		}
+		return nil
+	}
+	validDestType := func(s string) error {
+		switch s {
+		case "s3":
+		case "fs":
+			switch {
+			case c.Mode == "restore":
+				return errors.New("fs is not supported in restore mode")
+			case c.Backup.Stream:
+				return errors.New("fs is not supported with backup stream")
+			case len(c.S3Mirrors) != 0:
+				return errors.New("fs is not supported with s3 mirrors")
+			case c.Backup.Mode != "full":
+				return fmt.Errorf("fs is not supported with %s backup mode", c.Backup.Mode)
+			case c.Backup.WarnUnchanged:
+				return errors.New("fs is not supported with backup warn_unchanged")
+			}
+		default:
+			return errors.New("must be one of s3, fs")
+		}
+		return nil
+	}
+	// 1 is the exit code of failed runs.
+	validWarningExitCode := func(code *int) error {
+		if *code == 1 {
+			return errors.New("must differ from 1, which is used for failures")
+		}
+		return nil
+	}
+	validFS := func(fs *FSConfig) error {
+		if c.DestType != "fs" {
+			return nil
+		}
+		return fs.Validate()
+	}
+	validS3 := func(s3 *S3Config) error {
+		if c.DestType != "s3" {
+			return nil
+		}
+		return s3.Validate()
+	}
+	// The copy of a deduplicated archive doesn't have the extension restore relies on.
+	validLatestKey := func(s3 *S3Config) error {
+		if s3.LatestKey != "" && c.Backup.Mode == "dedup" {
+			return errors.New("latest_key is not supported with dedup backup mode")
+		}
+		return nil
+	}
+	validMirrors := func(mirrors *[]S3Config) error {
+		if len(*mirrors) != 0 && c.Backup.Stream {
+			return errors.New("mirrors are not supported with backup stream")
+		}
+		for i := range *mirrors {
+			if err := (*mirrors)[i].Validate(); err != nil {
+				return fmt.Errorf("%d: %w", i, err)
+			}
+			if err := validLatestKey(&(*mirrors)[i]); err != nil {
+				return fmt.Errorf("%d: %w", i, err)
+			}
+		}
+		return nil
+	}
 	return validation.All(
+		validation.String(c.Mode, "mode").With(validMode),
+		validation.Number(c.ScaleUpTimeout, "scaleup_timeout").Greater(0),
+		validation.Number(c.K8sMaxRetries, "k8s_max_retries").GreaterEqual(0),
+		validation.Number(c.WarningExitCode, "warning_exit_code").GreaterEqual(0).LessEqual(255),
+		validation.Ptr(&c.WarningExitCode, "warning_exit_code").With(validWarningExitCode),
 		validation.Ptr(&c.Resource, "resource").With(validation.Custom),
-		validation.Ptr(&c.Backup, "backup").With(validation.Custom),
-		validation.Ptr(&c.S3, "s3").With(validation.Custom),
+		validation.Ptr(&c.Backup, "backup").With(validation.Custom, validCopyFirst, validIncludeConfigsCustom),
+		validation.String(c.DestType, "dest_type").With(validDestType),
+		validation.Ptr(&c.FS, "fs").With(validFS),
+		validation.Ptr(&c.S3, "s3").With(validS3, validLatestKey),
+		validation.Ptr(&c.S3Mirrors, "s3_mirrors").With(validMirrors),
 		validation.Ptr(&c.Telegram, "telegram").With(validation.Custom),
+		validation.Ptr(&c.Slack, "slack").With(validation.Custom),
+		validation.Ptr(&c.Webhook, "webhook").With(validation.Custom),
+		validation.Ptr(&c.Metrics, "metrics").With(validation.Custom),
+		validation.Ptr(&c.Health, "health").With(validation.Custom),
+		validation.Ptr(&c.Snapshot, "snapshot").With(validation.Custom, validSnapshot),
+		validation.Ptr(&c.Hook, "hook").With(validation.Custom, validExecHooks),
+		validation.Ptr(&c.Lock, "lock").With(validation.Custom),
 	)
 }
+
+// Load reads the config from the YAML file specified by CONFIG_FILE, if any,
+// and from environment variables, which take precedence over the file.
+func (c *Config) Load() (err error) {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		if err := env.Parse(c); err != nil {
+			return fmt.Errorf("failed to parse environment variables: %w", err)
+		}
+		return nil
+	}
+
+	// Set defaults only, so that the file can override them.
+	if err := env.ParseWithOptions(c, env.Options{Environment: map[string]string{}}); err != nil {
+		return fmt.Errorf("failed to set defaults: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	// In the file, *_file options are paths, not the contents.
+	files := []*string{
+		&c.Backup.EncryptionKeyFile,
+		&c.S3.AccessKeyIDFile,
+		&c.S3.SecretAccessKeyFile,
+		&c.Telegram.BotTokenFile,
+	}
+	for i := range c.S3Mirrors {
+		files = append(files, &c.S3Mirrors[i].AccessKeyIDFile, &c.S3Mirrors[i].SecretAccessKeyFile)
+	}
+	for _, file := range files {
+		if *file == "" {
+			continue
+		}
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", *file, err)
+		}
+		*file = string(data)
+	}
+
+	// Don't set defaults again, otherwise they would override the file.
+	if err := env.ParseWithOptions(c, env.Options{DefaultValueTagName: "-"}); err != nil {
+		return fmt.Errorf("failed to parse environment variables: %w", err)
+	}
+
+	return nil
+}
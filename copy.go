@@ -0,0 +1,181 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/infastin/gorack/errdefer"
+)
+
+// copyDirectories copies the backup directories into a temporary directory,
+// so that the workload can be scaled back up before archiving.
+// The copies keep the base names of the directories, so that the archive looks the same.
+func (a *Application) copyDirectories(ctx context.Context) (dirs []string, cleanup func() error, err error) {
+	lg := log.FromContext(ctx)
+
+	root, err := os.MkdirTemp(a.config.Backup.TempDirectory(), ".k8s-backup-copy-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	cleanup = func() error {
+		// Contents of read-only directories can't be deleted otherwise.
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && d.IsDir() {
+				os.Chmod(path, 0o700)
+			}
+			return nil
+		})
+		return os.RemoveAll(root)
+	}
+	defer errdefer.Close(&err, cleanup)
+
+	var stats copyStats
+	for _, dir := range a.config.Backup.Directories {
+		target := filepath.Join(root, filepath.Base(dir))
+		if err := a.copyTree(ctx, dir, target, &stats); err != nil {
+			return nil, nil, fmt.Errorf("failed to copy %s: %w", dir, err)
+		}
+		dirs = append(dirs, target)
+	}
+
+	lg.Info("Copied directories", "files", stats.files, "size", byteCountIEC(stats.size))
+
+	return dirs, cleanup, nil
+}
+
+type copyStats struct {
+	files int
+	size  int64
+}
+
+// copyTree copies the directory tree preserving modes, ownership and modification times.
+// Excluded entries are skipped, since they wouldn't be archived anyway.
+func (a *Application) copyTree(ctx context.Context, src, dst string, stats *copyStats) (err error) {
+	type dirInfo struct {
+		name string
+		info fs.FileInfo
+	}
+	// Attributes of directories are set after their contents have been copied,
+	// since copying would change the modification time and read-only directories can't be written to.
+	var dirs []dirInfo
+
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("copying aborted: %w", err)
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && matchAnyPattern(a.config.Backup.Exclude, filepath.ToSlash(rel)) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if err := os.Mkdir(target, 0o700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirInfo{name: target, info: info})
+			return nil
+		case mode&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			if err := copyFile(ctx, path, target); err != nil {
+				return err
+			}
+			stats.files++
+			stats.size += info.Size()
+			a.health.progress()
+		default:
+			return fmt.Errorf("%s: cannot copy non-regular file", path)
+		}
+
+		return copyAttributes(target, info)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Nested directories go first, so that copying the attributes of a parent doesn't prevent it.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := copyAttributes(dirs[i].name, dirs[i].info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFile(ctx context.Context, src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer errdefer.Close(&err, out.Close)
+
+	if _, err := io.Copy(out, &contextReader{ctx: ctx, r: in}); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// copyAttributes sets ownership, mode and modification time of the copy to the ones of the original.
+func copyAttributes(target string, info fs.FileInfo) (err error) {
+	// Ownership is taken from the same place the archive takes it from.
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+
+	// Copying ownership requires privileges, which we might not have.
+	if err := os.Lchown(target, header.Uid, header.Gid); err != nil && !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+
+	// Mode must be set after the ownership, since chown clears setuid and setgid bits.
+	mode := info.Mode()
+	if err := os.Chmod(target, mode&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+
+	return os.Chtimes(target, time.Time{}, info.ModTime())
+}
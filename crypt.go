@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted archives have the following format:
+//
+//	magic (8 bytes) | version (1 byte) | salt (16 bytes) | chunk | chunk | ...
+//
+// The key is derived from the passphrase with scrypt (N=32768, r=8, p=1, 32 bytes).
+// Plaintext is split into 64 KiB chunks, each one is sealed with AES-256-GCM
+// with the nonce being the 11-byte big-endian chunk index followed by
+// a byte which is 1 for the last chunk and 0 otherwise.
+// The last chunk can be shorter than 64 KiB and even empty.
+const (
+	encMagic     = "K8SBKENC"
+	encVersion   = 1
+	encSaltSize  = 16
+	encChunkSize = 64 * 1024
+)
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	out     []byte
+	counter uint64
+}
+
+func newEncryptWriter(w io.Writer, passphrase string) (ew *encryptWriter, err error) {
+	salt := make([]byte, encSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	aead, err := newEncryptionAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(encMagic)+1+encSaltSize)
+	header = append(header, encMagic...)
+	header = append(header, encVersion)
+	header = append(header, salt...)
+
+	if _, err := w.Write(header); err != nil {
+		return nil, fmt.Errorf("failed to write header: %w", err)
+	}
+
+	return &encryptWriter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, encChunkSize),
+		out:  make([]byte, 0, encChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func newEncryptionAEAD(passphrase string, salt []byte) (aead cipher.AEAD, err error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (e *encryptWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		// Flush only when there is more data,
+		// since we don't know yet whether this chunk is the last one.
+		if len(e.buf) == encChunkSize {
+			if err := e.flush(false); err != nil {
+				return n, err
+			}
+		}
+		k := min(encChunkSize-len(e.buf), len(p))
+		e.buf = append(e.buf, p[:k]...)
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+// Close writes the last chunk, but doesn't close the underlying writer.
+func (e *encryptWriter) Close() error {
+	return e.flush(true)
+}
+
+func (e *encryptWriter) flush(last bool) error {
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[3:11], e.counter)
+	if last {
+		nonce[11] = 1
+	}
+
+	e.out = e.aead.Seal(e.out[:0], nonce[:], e.buf, nil)
+	if _, err := e.w.Write(e.out); err != nil {
+		return err
+	}
+
+	e.buf = e.buf[:0]
+	e.counter++
+
+	return nil
+}
+
+type decryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	in      []byte
+	out     []byte
+	buf     []byte // unread part of out
+	counter uint64
+	last    bool
+}
+
+func newDecryptReader(r io.Reader, passphrase string) (dr *decryptReader, err error) {
+	header := make([]byte, len(encMagic)+1+encSaltSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	if string(header[:len(encMagic)]) != encMagic {
+		return nil, errors.New("invalid header")
+	}
+	if version := header[len(encMagic)]; version != encVersion {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+
+	aead, err := newEncryptionAEAD(passphrase, header[len(encMagic)+1:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		r:    r,
+		aead: aead,
+		in:   make([]byte, encChunkSize+aead.Overhead()),
+		out:  make([]byte, 0, encChunkSize),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (n int, err error) {
+	for len(d.buf) == 0 {
+		if d.last {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	n, err := io.ReadFull(d.r, d.in)
+	switch {
+	case err == io.EOF:
+		return errors.New("unexpected end of encrypted data")
+	case err == io.ErrUnexpectedEOF:
+		// Only the last chunk can be shorter.
+		return d.open(d.in[:n], true)
+	case err != nil:
+		return err
+	}
+
+	// A full chunk can be the last one too, which is told by the nonce.
+	if err := d.open(d.in, false); err == nil {
+		return nil
+	}
+	if err := d.open(d.in, true); err != nil {
+		return err
+	}
+
+	// Nothing must follow the last chunk.
+	if _, err := io.ReadFull(d.r, d.in[:1]); err == nil {
+		return errors.New("unexpected data after the last chunk")
+	}
+
+	return nil
+}
+
+func (d *decryptReader) open(chunk []byte, last bool) (err error) {
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[3:11], d.counter)
+	if last {
+		nonce[11] = 1
+	}
+
+	plaintext, err := d.aead.Open(d.out[:0], nonce[:], chunk, nil)
+	if err != nil {
+		return errors.New("failed to decrypt: wrong key or corrupted data")
+	}
+
+	d.buf = plaintext
+	d.counter++
+	d.last = last
+
+	return nil
+}
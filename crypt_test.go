@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestEncryptRoundTrip(t *testing.T) {
+	const headerSize = len(encMagic) + 1 + encSaltSize
+
+	tests := []struct {
+		name       string
+		size       int
+		passphrase string                // used for decryption, if differs
+		modify     func(b []byte) []byte // of the encrypted data
+		wantErr    bool
+	}{
+		{name: "empty", size: 0},
+		{name: "less than chunk", size: 100},
+		{name: "chunk boundary", size: encChunkSize},
+		{name: "chunk boundary plus one", size: encChunkSize + 1},
+		{name: "several chunks", size: 3*encChunkSize + 5},
+		{name: "wrong passphrase", size: 100, passphrase: "wrong", wantErr: true},
+		{
+			name: "truncated to full chunk",
+			size: encChunkSize + 1,
+			modify: func(b []byte) []byte {
+				return b[:headerSize+encChunkSize+16]
+			},
+			wantErr: true,
+		},
+		{
+			name: "truncated last chunk",
+			size: encChunkSize + 100,
+			modify: func(b []byte) []byte {
+				return b[:len(b)-10]
+			},
+			wantErr: true,
+		},
+		{
+			name: "tampered chunk",
+			size: 2 * encChunkSize,
+			modify: func(b []byte) []byte {
+				b[headerSize+100] ^= 1
+				return b
+			},
+			wantErr: true,
+		},
+		{
+			name: "trailing data",
+			size: encChunkSize,
+			modify: func(b []byte) []byte {
+				return append(b, 0)
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext := make([]byte, tt.size)
+			rand.Read(plaintext)
+
+			var encrypted bytes.Buffer
+			ew, err := newEncryptWriter(&encrypted, "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Written in odd pieces, so that they don't line up with the chunks.
+			for rest := plaintext; len(rest) > 0; {
+				k := min(1000, len(rest))
+				if _, err := ew.Write(rest[:k]); err != nil {
+					t.Fatal(err)
+				}
+				rest = rest[k:]
+			}
+			if err := ew.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			data := encrypted.Bytes()
+			if tt.modify != nil {
+				data = tt.modify(data)
+			}
+
+			passphrase := "secret"
+			if tt.passphrase != "" {
+				passphrase = tt.passphrase
+			}
+
+			var decrypted []byte
+			dr, err := newDecryptReader(bytes.NewReader(data), passphrase)
+			if err == nil {
+				decrypted, err = io.ReadAll(dr)
+			}
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Fatalf("got %d bytes different from the %d encrypted ones", len(decrypted), len(plaintext))
+			}
+		})
+	}
+}
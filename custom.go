@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// customResources reports whether the resources are custom resources of RESOURCE_API_GROUP
+// instead of the built-in kinds.
+func (a *Application) customResources() bool {
+	return a.config.Resource.APIGroup != ""
+}
+
+// customResource returns the dynamic client for the custom resources of the given type in the namespace.
+func (a *Application) customResource(typ string) dynamic.ResourceInterface {
+	gvr := schema.GroupVersionResource{
+		Group:    a.config.Resource.APIGroup,
+		Version:  a.config.Resource.APIVersion,
+		Resource: typ,
+	}
+	return a.dynamicClient.Resource(gvr).Namespace(a.config.Resource.Namespace)
+}
+
+// discoverCustomResources sets the kinds of the custom resources,
+// which are needed for events and manifests,
+// and checks early that they can be scaled.
+func (a *Application) discoverCustomResources() (err error) {
+	gv := schema.GroupVersion{
+		Group:   a.config.Resource.APIGroup,
+		Version: a.config.Resource.APIVersion,
+	}
+
+	list, err := a.clientset.Discovery().ServerResourcesForGroupVersion(gv.String())
+	if err != nil {
+		return fmt.Errorf("failed to discover resources of %s: %w", gv, err)
+	}
+
+	kinds := make(map[string]string, len(list.APIResources))
+	for i := range list.APIResources {
+		kinds[list.APIResources[i].Name] = list.APIResources[i].Kind
+	}
+
+	for i := range a.resources {
+		res := &a.resources[i]
+
+		kind, ok := kinds[res.Type]
+		if !ok {
+			return fmt.Errorf("resource %s not found in %s", res.Type, gv)
+		}
+		if _, ok := kinds[res.Type+"/scale"]; !ok && !a.config.Resource.SkipScale {
+			return fmt.Errorf("%s %w", res.ID, errNoScale)
+		}
+
+		res.Kind = kind
+	}
+
+	return nil
+}
+
+// dynamicScaleClient is the scaleClient of custom resources,
+// whose scale subresource is served as autoscaling/v1 Scale as well.
+type dynamicScaleClient struct {
+	client dynamic.ResourceInterface
+}
+
+func (c *dynamicScaleClient) GetScale(ctx context.Context, name string, opts metav1.GetOptions) (*autoscalingv1.Scale, error) {
+	obj, err := c.client.Get(ctx, name, opts, "scale")
+	if err != nil {
+		return nil, err
+	}
+	return scaleFromUnstructured(obj)
+}
+
+func (c *dynamicScaleClient) UpdateScale(ctx context.Context, name string, scale *autoscalingv1.Scale, opts metav1.UpdateOptions) (*autoscalingv1.Scale, error) {
+	data, err := runtime.DefaultUnstructuredConverter.ToUnstructured(scale)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert scale: %w", err)
+	}
+
+	obj := &unstructured.Unstructured{Object: data}
+	obj.SetGroupVersionKind(autoscalingv1.SchemeGroupVersion.WithKind("Scale"))
+
+	obj, err = c.client.Update(ctx, obj, opts, "scale")
+	if err != nil {
+		return nil, err
+	}
+	return scaleFromUnstructured(obj)
+}
+
+func scaleFromUnstructured(obj *unstructured.Unstructured) (scale *autoscalingv1.Scale, err error) {
+	scale = new(autoscalingv1.Scale)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, scale); err != nil {
+		return nil, fmt.Errorf("failed to convert scale: %w", err)
+	}
+	return scale, nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/minio/minio-go/v7"
+	"golang.org/x/time/rate"
+)
+
+// Extension of deduplicated archives, which are stored as a list of chunks.
+const chunksExtension = ".chunks"
+
+// chunkList is stored in place of a deduplicated archive.
+// Chunks are stored under their SHA-256 checksum, so that identical ones are stored only once.
+type chunkList struct {
+	Compressed bool        `json:"compressed"`
+	Size       int64       `json:"size"`
+	Chunks     []chunkInfo `json:"chunks"`
+}
+
+type chunkInfo struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+}
+
+// chunkName returns the name of the chunk object.
+// Compressed chunks are stored separately, so that changing BACKUP_COMPRESS doesn't break older archives.
+func chunkName(id string, compressed bool) string {
+	if compressed {
+		return id + ".gz"
+	}
+	return id
+}
+
+// gearTable maps bytes to random values for the rolling hash.
+// It must never change, otherwise chunk boundaries shift and nothing is deduplicated.
+var gearTable = func() (table [256]uint64) {
+	// splitmix64 with a fixed seed.
+	x := uint64(0x6b38732d6261636b)
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker splits a stream into content-defined chunks with the gear rolling hash,
+// so that an insertion or a deletion changes only the chunks around it.
+type chunker struct {
+	r    *bufio.Reader
+	min  int
+	max  int
+	mask uint64
+	buf  []byte
+}
+
+// newChunker returns a chunker producing chunks of avg size on average,
+// but no less than a quarter and no more than four times of it.
+func newChunker(r io.Reader, avg int) *chunker {
+	// A boundary is where the top bits of the hash are zero.
+	n := bits.Len(uint(avg - 1))
+	return &chunker{
+		r:    bufio.NewReader(r),
+		min:  avg / 4,
+		max:  avg * 4,
+		mask: (1<<n - 1) << (64 - n),
+		buf:  make([]byte, 0, avg*4),
+	}
+}
+
+// next returns the next chunk, which is valid until the next call, or io.EOF.
+func (c *chunker) next() (chunk []byte, err error) {
+	c.buf = c.buf[:0]
+
+	var hash uint64
+	for len(c.buf) < c.max {
+		b, err := c.r.ReadByte()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+
+		hash = hash<<1 + gearTable[b]
+		if len(c.buf) >= c.min && hash&c.mask == 0 {
+			break
+		}
+	}
+
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+
+	return c.buf, nil
+}
+
+// chunkPrefix returns the prefix of the chunks of the resources.
+// It doesn't depend on the date, so that chunks are shared between backups,
+// but it does depend on the resources, so that pruning doesn't delete chunks of other backups.
+func (a *Application) chunkPrefix(config *S3Config) string {
+	name := a.config.Resource.Namespace + "." + a.resourceNames("+") + chunksExtension + "/"
+
+	prefix := strings.TrimRight(a.pruneKeyPrefix(config), "/")
+	if prefix == "" {
+		return name
+	}
+
+	return prefix + "/" + name
+}
+
+// listChunks returns names of the chunks stored in the bucket.
+func (a *Application) listChunks(ctx context.Context, dst *destination) (chunks map[string]struct{}, err error) {
+	chunks = make(map[string]struct{})
+	for obj := range dst.client.ListObjects(ctx, dst.config.Bucket, minio.ListObjectsOptions{
+		Prefix: a.chunkPrefix(dst.config),
+	}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("failed to list chunks: %w", obj.Err)
+		}
+		chunks[path.Base(obj.Key)] = struct{}{}
+	}
+	return chunks, nil
+}
+
+// uploadChunks splits the archive into chunks, uploads the ones missing in the bucket
+// and then the list of the chunks in place of the archive.
+func (a *Application) uploadChunks(ctx context.Context, dst *destination) (err error) {
+	lg := log.FromContext(ctx)
+
+	existing, err := a.listChunks(ctx, dst)
+	if err != nil {
+		return err
+	}
+
+	lg.Info("Uploading archive chunks to S3", "existing_chunks", len(existing))
+
+	if _, err := a.archiveFile.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek archive file: %w", err)
+	}
+
+	var limiter *rate.Limiter
+	if dst.config.MaxBandwidth != 0 {
+		limit := int(dst.config.MaxBandwidth)
+		limiter = rate.NewLimiter(rate.Limit(limit), limit)
+	}
+
+	list := chunkList{Compressed: a.config.Backup.Compress}
+	prefix := a.chunkPrefix(dst.config)
+	chunker := newChunker(a.archiveFile, int(a.config.Backup.ChunkSize))
+
+	var (
+		uploaded      int
+		uploadedBytes int64
+		lastLog       = time.Now()
+		interval      = time.Duration(dst.config.ProgressInterval)
+	)
+
+	for {
+		chunk, err := chunker.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		a.health.progress()
+
+		sum := sha256.Sum256(chunk)
+		id := hex.EncodeToString(sum[:])
+		list.Chunks = append(list.Chunks, chunkInfo{ID: id, Size: int64(len(chunk))})
+		list.Size += int64(len(chunk))
+
+		name := chunkName(id, list.Compressed)
+		if _, ok := existing[name]; ok {
+			continue
+		}
+
+		data := chunk
+		if list.Compressed {
+			data, err = gzipBytes(chunk)
+			if err != nil {
+				return fmt.Errorf("failed to compress chunk: %w", err)
+			}
+		}
+
+		var r io.Reader = bytes.NewReader(data)
+		if limiter != nil {
+			r = &throttledReader{ctx: ctx, r: r, limiter: limiter}
+		}
+
+		if _, err := dst.client.PutObject(ctx,
+			dst.config.Bucket,
+			prefix+name,
+			r,
+			int64(len(data)),
+			minio.PutObjectOptions{
+				StorageClass:         dst.config.StorageClass,
+				ContentType:          "application/octet-stream",
+				ServerSideEncryption: dst.encryption,
+			},
+		); err != nil {
+			return fmt.Errorf("failed to upload chunk %s: %w", id, err)
+		}
+
+		existing[name] = struct{}{}
+		uploaded++
+		uploadedBytes += int64(len(data))
+
+		if time.Since(lastLog) >= interval {
+			lastLog = time.Now()
+			lg.Infof("Uploaded %s / %s", byteCountIEC(list.Size), byteCountIEC(a.archiveSize))
+		}
+	}
+
+	data, err := json.Marshal(&list)
+	if err != nil {
+		return fmt.Errorf("failed to marshal chunk list: %w", err)
+	}
+
+	opts := a.putObjectOptions(dst)
+	opts.PartSize = 0
+
+	if _, err := dst.client.PutObject(ctx,
+		dst.config.Bucket,
+		dst.archiveKey,
+		bytes.NewReader(data),
+		int64(len(data)),
+		opts,
+	); err != nil {
+		return fmt.Errorf("failed to upload chunk list: %w", err)
+	}
+
+	lg.Info("Uploaded archive chunks to S3",
+		"chunks", len(list.Chunks),
+		"uploaded_chunks", uploaded,
+		"uploaded_size", byteCountIEC(uploadedBytes),
+	)
+
+	return nil
+}
+
+// downloadChunks reads the chunk list from r and writes the chunks to w,
+// reassembling the archive.
+func (a *Application) downloadChunks(ctx context.Context, dst *destination, r io.Reader, w io.Writer) (size int64, err error) {
+	var list chunkList
+	if err := json.NewDecoder(r).Decode(&list); err != nil {
+		return 0, fmt.Errorf("failed to read chunk list: %w", err)
+	}
+
+	log.FromContext(ctx).Info("Downloading archive chunks from S3", "chunks", len(list.Chunks))
+
+	prefix := a.chunkPrefix(dst.config)
+	for _, chunk := range list.Chunks {
+		n, err := a.downloadChunk(ctx, dst, prefix+chunkName(chunk.ID, list.Compressed), list.Compressed, w)
+		if err != nil {
+			return size, fmt.Errorf("failed to download chunk %s: %w", chunk.ID, err)
+		}
+		if n != chunk.Size {
+			return size, fmt.Errorf("chunk %s has %d bytes instead of %d", chunk.ID, n, chunk.Size)
+		}
+		size += n
+	}
+
+	if size != list.Size {
+		return size, fmt.Errorf("archive has %d bytes instead of %d", size, list.Size)
+	}
+
+	return size, nil
+}
+
+func (a *Application) downloadChunk(ctx context.Context, dst *destination, key string, compressed bool, w io.Writer) (n int64, err error) {
+	obj, err := dst.client.GetObject(ctx, dst.config.Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer obj.Close()
+
+	var r io.Reader = obj
+	if compressed {
+		gr, err := gzip.NewReader(bufio.NewReader(obj))
+		if err != nil {
+			return 0, err
+		}
+		r = gr
+	}
+
+	return io.Copy(w, r)
+}
+
+// pruneChunks deletes chunks which are no longer referenced by any archive.
+// It must be called after pruning the archives.
+func (a *Application) pruneChunks(ctx context.Context, dst *destination) (err error) {
+	lg := log.FromContext(ctx)
+	lg.Info("Pruning unreferenced chunks")
+
+	archives, err := a.listArchives(ctx, dst)
+	if err != nil {
+		return err
+	}
+
+	referenced := make(map[string]struct{})
+	for _, obj := range archives {
+		if !strings.HasSuffix(obj.Key, chunksExtension) {
+			continue
+		}
+
+		list, err := a.getChunkList(ctx, dst, obj.Key)
+		if err != nil {
+			return err
+		}
+		for _, chunk := range list.Chunks {
+			referenced[chunkName(chunk.ID, list.Compressed)] = struct{}{}
+		}
+	}
+
+	chunks, err := a.listChunks(ctx, dst)
+	if err != nil {
+		return err
+	}
+
+	prefix := a.chunkPrefix(dst.config)
+	deleted := 0
+	for name := range chunks {
+		if _, ok := referenced[name]; ok {
+			continue
+		}
+
+		if a.config.DryRun {
+			lg.Info("Dry run: skipping deletion of unreferenced chunk", "name", name)
+			continue
+		}
+
+		if err := dst.client.RemoveObject(ctx, dst.config.Bucket, prefix+name, minio.RemoveObjectOptions{}); err != nil {
+			return fmt.Errorf("failed to delete chunk %s: %w", name, err)
+		}
+		deleted++
+	}
+
+	lg.Info("Pruned unreferenced chunks", "kept", len(referenced), "deleted", deleted)
+
+	return nil
+}
+
+func (a *Application) getChunkList(ctx context.Context, dst *destination, key string) (list *chunkList, err error) {
+	obj, err := dst.client.GetObject(ctx, dst.config.Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chunk list %s: %w", key, err)
+	}
+	defer obj.Close()
+
+	list = new(chunkList)
+	if err := json.NewDecoder(bufio.NewReader(obj)).Decode(list); err != nil {
+		return nil, fmt.Errorf("failed to read chunk list %s: %w", key, err)
+	}
+
+	return list, nil
+}
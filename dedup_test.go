@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// uploadTestChunks uploads the data as the deduplicated archive with the given key
+// and returns the keys of the chunks uploaded by it.
+func uploadTestChunks(t *testing.T, a *Application, dst *destination, s3 *fakeS3, key string, data []byte) (uploaded []string) {
+	t.Helper()
+
+	file, err := os.Create(filepath.Join(t.TempDir(), "backup.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	before := s3.keys(a.chunkPrefix(dst.config))
+
+	a.archiveFile = file
+	a.archiveSize = int64(len(data))
+	dst.archiveKey = key
+	if err := a.uploadChunks(context.Background(), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range s3.keys(a.chunkPrefix(dst.config)) {
+		if !slices.Contains(before, key) {
+			uploaded = append(uploaded, key)
+		}
+	}
+	return uploaded
+}
+
+func TestDedup(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		name := "plain"
+		if compressed {
+			name = "compressed"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			dst, s3 := newFakeS3(t)
+
+			a := &Application{
+				health:    newHealth(time.Minute),
+				resources: []resource{parseResource("deployment/db")},
+			}
+			a.config.Resource.Namespace = "default"
+			a.config.Backup.Mode = "dedup"
+			a.config.Backup.ChunkSize = 4 * 1024
+			a.config.Backup.Compress = compressed
+
+			rng := rand.New(rand.NewPCG(1, 2))
+			data := make([]byte, 256*1024)
+			for i := range data {
+				data[i] = byte(rng.Uint32())
+			}
+
+			first := uploadTestChunks(t, a, dst, s3, "backup-1.tar.chunks", data)
+			if len(first) == 0 {
+				t.Fatal("no chunks uploaded")
+			}
+
+			// Identical content is stored only once.
+			if again := uploadTestChunks(t, a, dst, s3, "backup-2.tar.chunks", data); len(again) != 0 {
+				t.Errorf("uploaded %d chunks of identical content", len(again))
+			}
+
+			// Chunks are content-defined, so an insertion changes only the chunks around it.
+			changed := slices.Concat(data[:100*1024], []byte("inserted"), data[100*1024:])
+			if uploaded := uploadTestChunks(t, a, dst, s3, "backup-3.tar.chunks", changed); len(uploaded) > 3 {
+				t.Errorf("uploaded %d of %d chunks after a small insertion", len(uploaded), len(first))
+			}
+
+			for key, want := range map[string][]byte{
+				"backup-1.tar.chunks": data,
+				"backup-2.tar.chunks": data,
+				"backup-3.tar.chunks": changed,
+			} {
+				var b bytes.Buffer
+				size, err := a.downloadChunks(context.Background(), dst, bytes.NewReader(s3.object(key)), &b)
+				if err != nil {
+					t.Fatalf("%s: %v", key, err)
+				}
+				if size != int64(len(want)) || !bytes.Equal(b.Bytes(), want) {
+					t.Errorf("%s: restored %d bytes different from the %d archived ones", key, size, len(want))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/infastin/gorack/errdefer"
+	"github.com/minio/minio-go/v7"
+)
+
+// Destination stores archives.
+type Destination interface {
+	// Store stores the archive of the given size read from r under the name.
+	Store(ctx context.Context, name string, r io.Reader, size int64) error
+}
+
+// s3Store stores archives in the bucket of the destination.
+type s3Store struct {
+	dst  *destination
+	opts minio.PutObjectOptions
+}
+
+func (s *s3Store) Store(ctx context.Context, name string, r io.Reader, size int64) (err error) {
+	_, err = s.dst.client.PutObject(ctx,
+		s.dst.config.Bucket,
+		name,
+		s.dst.throttle(ctx, r),
+		size,
+		s.opts,
+	)
+	return err
+}
+
+// fsDestination stores archives in a directory, e.g. a mounted NFS share.
+type fsDestination struct {
+	dir      string
+	progress io.Writer // reported to while copying
+}
+
+func (d *fsDestination) Store(ctx context.Context, name string, r io.Reader, size int64) (err error) {
+	// Copy to a temporary file first, so that an incomplete archive never appears under the name.
+	file, err := os.CreateTemp(d.dir, "."+name+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer errdefer.Close(&err, func() error {
+		file.Close()
+		return os.Remove(file.Name())
+	})
+
+	n, err := io.Copy(io.MultiWriter(file, d.progress), &contextReader{ctx: ctx, r: r})
+	if err != nil {
+		return fmt.Errorf("failed to copy archive: %w", err)
+	}
+	if n != size {
+		return fmt.Errorf("copied %d bytes instead of %d", n, size)
+	}
+
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+
+	if err := os.Rename(file.Name(), filepath.Join(d.dir, name)); err != nil {
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+
+	return nil
+}
+
+// contextReader stops reading once the context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(b []byte) (n int, err error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(b)
+}
+
+// storeArchive stores the archive file in the destination under the name.
+func (a *Application) storeArchive(ctx context.Context, dst Destination, name string) (err error) {
+	// The file has just been written, so it must be read from the beginning.
+	if _, err := a.archiveFile.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek archive file: %w", err)
+	}
+	return dst.Store(ctx, name, a.archiveFile, a.archiveSize)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/charmbracelet/log"
+)
+
+// withFrozen freezes the file systems of the backup directories, calls fn and thaws them,
+// so that the directories are archived consistently without scaling the workload down.
+// Writes to the file systems block while they are frozen.
+func (a *Application) withFrozen(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	lg := log.FromContext(ctx)
+
+	if a.config.DryRun {
+		lg.Info("Dry run: skipping freezing file systems")
+		return fn(ctx)
+	}
+
+	// The archive is written while the file systems are frozen, which would block forever.
+	tempDir := a.config.Backup.TempDirectory()
+	tempDev, err := fileDevice(tempDir)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", tempDir, err)
+	}
+
+	var frozen []*os.File
+	defer func() {
+		var errs []error
+		for _, dir := range slices.Backward(frozen) {
+			if thawErr := thawFS(dir); thawErr != nil {
+				errs = append(errs, fmt.Errorf("failed to thaw %s: %w", dir.Name(), thawErr))
+			} else {
+				lg.Info("Successfuly thawed file system", "directory", dir.Name())
+			}
+			dir.Close()
+		}
+		if thawErr := errors.Join(errs...); thawErr != nil {
+			lg.Error("Failed to thaw file systems", "error", thawErr)
+			if err != nil {
+				err = fmt.Errorf("%w: %w", err, thawErr)
+			} else {
+				err = thawErr
+			}
+		}
+	}()
+
+	devices := make(map[uint64]struct{})
+	for _, dir := range a.config.Backup.Directories {
+		dev, err := fileDevice(dir)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", dir, err)
+		}
+		if dev == tempDev {
+			return fmt.Errorf("temporary directory %s is on the same file system as %s", tempDir, dir)
+		}
+		// Directories on the same file system are frozen once.
+		if _, ok := devices[dev]; ok {
+			continue
+		}
+		devices[dev] = struct{}{}
+
+		file, err := os.Open(dir)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", dir, err)
+		}
+
+		lg.Info("Trying to freeze file system", "directory", dir)
+		if err := freezeFS(file); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to freeze %s: %w", dir, err)
+		}
+		frozen = append(frozen, file)
+		lg.Info("Successfuly froze file system", "directory", dir)
+	}
+
+	return fn(ctx)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// FIFREEZE and FITHAW from linux/fs.h, i.e. _IOWR('X', 119, int) and _IOWR('X', 120, int),
+// as encoded on x86 and arm.
+const (
+	fiFreeze = 0xc0045877
+	fiThaw   = 0xc0045878
+)
+
+// fileDevice returns the id of the file system the file is on.
+func fileDevice(path string) (dev uint64, err error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Dev), nil
+}
+
+// freezeFS freezes the file system the file is on, which requires CAP_SYS_ADMIN.
+func freezeFS(file *os.File) error {
+	return ioctl(file, fiFreeze)
+}
+
+// thawFS thaws the file system frozen by freezeFS.
+func thawFS(file *os.File) error {
+	return ioctl(file, fiThaw)
+}
+
+func ioctl(file *os.File, req uintptr) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, file.Fd(), req, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errFreezeUnsupported = errors.New("freezing file systems is supported only on Linux")
+
+func fileDevice(path string) (dev uint64, err error) {
+	return 0, errFreezeUnsupported
+}
+
+func freezeFS(file *os.File) error {
+	return errFreezeUnsupported
+}
+
+func thawFS(file *os.File) error {
+	return errFreezeUnsupported
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// health tracks the current phase of the run and when it has last made progress,
+// so that a liveness probe can tell whether it is stuck.
+type health struct {
+	mu           sync.Mutex
+	phase        string
+	lastProgress time.Time
+	timeout      time.Duration
+}
+
+func newHealth(timeout time.Duration) *health {
+	return &health{
+		phase:        "starting",
+		lastProgress: time.Now(),
+		timeout:      timeout,
+	}
+}
+
+// setPhase sets the current phase, entering a phase counts as progress.
+func (h *health) setPhase(phase string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.phase = phase
+	h.lastProgress = time.Now()
+}
+
+func (h *health) progress() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastProgress = time.Now()
+}
+
+// Write reports progress, so that archiving and downloading can be tracked.
+func (h *health) Write(b []byte) (n int, err error) {
+	h.progress()
+	return len(b), nil
+}
+
+type healthStatus struct {
+	Phase        string    `json:"phase"`
+	LastProgress time.Time `json:"last_progress"`
+}
+
+func (h *health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	status := healthStatus{
+		Phase:        h.phase,
+		LastProgress: h.lastProgress,
+	}
+	stalled := time.Since(h.lastProgress) > h.timeout
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if stalled {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(&status)
+}
+
+func (a *Application) serveHealth() {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", a.health)
+
+	server := &http.Server{
+		Addr:              a.config.Health.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			a.lg.Error("Failed to serve health", "error", err)
+		}
+	}()
+}
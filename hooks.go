@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// hookPod returns the name of the pod to execute hooks in.
+func (a *Application) hookPod(ctx context.Context) (pod string, err error) {
+	if a.config.Hook.Pod != "" {
+		return a.config.Hook.Pod, nil
+	}
+
+	list, err := a.clientset.CoreV1().
+		Pods(a.config.Resource.Namespace).
+		List(ctx, metav1.ListOptions{LabelSelector: a.config.Hook.PodSelector})
+	if err != nil {
+		return "", fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	for i := range list.Items {
+		if list.Items[i].Status.Phase == corev1.PodRunning {
+			return list.Items[i].Name, nil
+		}
+	}
+
+	return "", errors.New("no running pods found")
+}
+
+// execHook executes the command with sh -c in the hook pod.
+func (a *Application) execHook(ctx context.Context, command string) (err error) {
+	lg := log.FromContext(ctx)
+
+	pod, err := a.hookPod(ctx)
+	if err != nil {
+		return err
+	}
+
+	lg = lg.With("pod", pod)
+	lg.Info("Trying to execute hook", "command", command)
+
+	req := a.clientset.CoreV1().RESTClient().
+		Post().
+		Namespace(a.config.Resource.Namespace).
+		Resource("pods").
+		Name(pod).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: a.config.Hook.Container,
+			Command:   []string{"sh", "-c", command},
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(a.restConfig, "POST", req.URL())
+	if err != nil {
+		return fmt.Errorf("failed to create executor: %w", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+
+	if stdout.Len() != 0 {
+		lg.Info("Hook stdout", "output", strings.TrimRight(stdout.String(), "\n"))
+	}
+	if stderr.Len() != 0 {
+		lg.Info("Hook stderr", "output", strings.TrimRight(stderr.String(), "\n"))
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to execute hook: %w", err)
+	}
+
+	lg.Info("Successfuly executed hook")
+
+	return nil
+}
+
+// commandHook runs the command with sh -c locally.
+func (a *Application) commandHook(ctx context.Context, command string) (err error) {
+	lg := log.FromContext(ctx)
+	lg.Info("Trying to run command", "command", command)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+
+	if stdout.Len() != 0 {
+		lg.Info("Command stdout", "output", strings.TrimRight(stdout.String(), "\n"))
+	}
+	if stderr.Len() != 0 {
+		lg.Info("Command stderr", "output", strings.TrimRight(stderr.String(), "\n"))
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to run command: %w", err)
+	}
+
+	lg.Info("Successfuly ran command")
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Annotation recording the replica range of a HorizontalPodAutoscaler paused by the backup,
+// so that it can be restored by hand if the backup is killed before restoring it.
+const pausedReplicasAnnotation = "k8s-backup/paused-replicas"
+
+type (
+	objectForNullableAnnotations struct {
+		Annotations map[string]*string `json:"annotations"`
+	}
+
+	objectForHPAReplicas struct {
+		MinReplicas *int32 `json:"minReplicas"` // null resets it to the default
+		MaxReplicas int32  `json:"maxReplicas"`
+	}
+
+	objectForHPA struct {
+		Metadata objectForNullableAnnotations `json:"metadata"`
+		Spec     objectForHPAReplicas         `json:"spec"`
+	}
+)
+
+// findHPA returns the HorizontalPodAutoscaler targeting the resource, or nil if there is none.
+func (a *Application) findHPA(ctx context.Context, res *resource) (hpa *autoscalingv2.HorizontalPodAutoscaler, err error) {
+	var hpas *autoscalingv2.HorizontalPodAutoscalerList
+	err = a.retryK8s(ctx, func() (err error) {
+		hpas, err = a.clientset.AutoscalingV2().
+			HorizontalPodAutoscalers(a.config.Resource.Namespace).
+			List(ctx, metav1.ListOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list horizontal pod autoscalers: %w", err)
+	}
+
+	gv := a.resourceGroupVersion(res)
+	for i := range hpas.Items {
+		ref := &hpas.Items[i].Spec.ScaleTargetRef
+		group, _, _ := strings.Cut(ref.APIVersion, "/")
+		if group == gv.Group && ref.Kind == res.Kind && ref.Name == res.Name {
+			return &hpas.Items[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// handleHPA deals with the HorizontalPodAutoscaler targeting the resource according to RESOURCE_HANDLE_HPA,
+// since it would scale the resource back up while it is being backed up.
+// If the autoscaler is paused, undo resumes it, which should be done before scaling the resource back up,
+// so that the paused autoscaler doesn't scale it down again.
+func (a *Application) handleHPA(ctx context.Context, res *resource) (undo func(context.Context) error, err error) {
+	lg := log.FromContext(ctx)
+	lg.Info("Trying to find horizontal pod autoscaler")
+
+	hpa, err := a.findHPA(ctx, res)
+	if err != nil {
+		return nil, err
+	}
+	if hpa == nil {
+		lg.Info("Resource has no horizontal pod autoscaler")
+		return nil, nil
+	}
+
+	lg = lg.With("hpa", hpa.Name)
+
+	switch a.config.Resource.HandleHPA {
+	case "refuse":
+		return nil, fmt.Errorf("resource is managed by horizontal pod autoscaler %s, set RESOURCE_HANDLE_HPA=pause to pause it during the backup", hpa.Name)
+	case "warn":
+		a.warn(lg, "Resource is managed by horizontal pod autoscaler, which may scale it back up")
+		return nil, nil
+	}
+
+	if a.config.DryRun {
+		lg.Info("Dry run: skipping pausing horizontal pod autoscaler")
+		return nil, nil
+	}
+
+	// The autoscaler keeps the number of replicas between the bounds, and it doesn't act on
+	// resources scaled to zero, so pinning them to the target (at least 1) pauses it.
+	pinned := max(int32(a.scaleTarget()), 1)
+	minReplicas, maxReplicas := hpa.Spec.MinReplicas, hpa.Spec.MaxReplicas
+
+	original := strconv.Itoa(int(maxReplicas))
+	if minReplicas != nil {
+		original = strconv.Itoa(int(*minReplicas)) + "-" + original
+	}
+
+	lg.Info("Trying to pause horizontal pod autoscaler", "replicas", original)
+
+	if err := a.patchHPA(ctx, hpa.Name, &pinned, pinned, &original); err != nil {
+		return nil, fmt.Errorf("failed to pause horizontal pod autoscaler %s: %w", hpa.Name, err)
+	}
+
+	lg.Info("Successfuly paused horizontal pod autoscaler")
+
+	undo = func(ctx context.Context) error {
+		lg := log.FromContext(ctx).With("resource", res.ID, "hpa", hpa.Name)
+		lg.Info("Trying to resume horizontal pod autoscaler")
+
+		if err := a.patchHPA(ctx, hpa.Name, minReplicas, maxReplicas, nil); err != nil {
+			return fmt.Errorf("failed to resume horizontal pod autoscaler %s of %s: %w", hpa.Name, res.ID, err)
+		}
+
+		lg.Info("Successfuly resumed horizontal pod autoscaler")
+
+		return nil
+	}
+
+	return undo, nil
+}
+
+// patchHPA sets the replica range of the HorizontalPodAutoscaler
+// and the annotation with the paused one, which is removed if nil.
+func (a *Application) patchHPA(ctx context.Context, name string, minReplicas *int32, maxReplicas int32, paused *string) (err error) {
+	obj := objectForHPA{
+		Metadata: objectForNullableAnnotations{
+			Annotations: map[string]*string{pausedReplicasAnnotation: paused},
+		},
+		Spec: objectForHPAReplicas{
+			MinReplicas: minReplicas,
+			MaxReplicas: maxReplicas,
+		},
+	}
+
+	patch, err := json.Marshal(&obj)
+	if err != nil {
+		return fmt.Errorf("failed to marshal patch: %w", err)
+	}
+
+	return a.retryK8s(ctx, func() (err error) {
+		_, err = a.clientset.AutoscalingV2().
+			HorizontalPodAutoscalers(a.config.Resource.Namespace).
+			Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+		return err
+	})
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/minio/minio-go/v7"
+)
+
+// Name of the archive entry listing entries deleted since the previous backup.
+const deletedName = "deleted"
+
+// PAX record marking the entry listing deleted entries,
+// so that restore can tell it apart from a file with the same name.
+const deletedPAXRecord = "K8SBACKUP.deleted"
+
+// User metadata keys of the backup mode and of the name of the archive the incremental one is based on.
+const (
+	modeMetadataKey   = "Backup-Mode"
+	parentMetadataKey = "Backup-Parent"
+)
+
+// backupIndex lists entries of the last backup, so that the next incremental one
+// archives only the files changed since. It is stored in the bucket next to the archives.
+type backupIndex struct {
+	// Names of the full archive and the incremental archives based on it, oldest first.
+	Chain []string              `json:"chain"`
+	Files map[string]indexEntry `json:"files"`
+}
+
+type indexEntry struct {
+	ModTime int64 `json:"mtime"` // in nanoseconds
+	Size    int64 `json:"size"`
+}
+
+// indexKey returns the key of the index, which doesn't depend on the date,
+// so that it can be found by the next backup.
+func (a *Application) indexKey(config *S3Config) string {
+	return a.stateKey(config, "index.json")
+}
+
+// stateKey returns the key of the object of the given kind
+// that the backups of the resources keep between runs next to the archives.
+func (a *Application) stateKey(config *S3Config, kind string) string {
+	name := a.config.Resource.Namespace + "." + a.resourceNames("+") + "." + kind
+
+	prefix := strings.TrimRight(a.pruneKeyPrefix(config), "/")
+	if prefix == "" {
+		return name
+	}
+
+	return prefix + "/" + name
+}
+
+// loadIndex loads the index of the previous backup, which the incremental backup is based on.
+// A full backup is made instead if there is no index or the chain is already long enough.
+func (a *Application) loadIndex(ctx context.Context, dst *destination) (err error) {
+	key := a.indexKey(dst.config)
+
+	lg := log.FromContext(ctx).With("index", key)
+	lg.Info("Trying to load backup index")
+
+	a.index = &backupIndex{Files: make(map[string]indexEntry)}
+
+	obj, err := dst.client.GetObject(ctx, dst.config.Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get backup index: %w", err)
+	}
+	defer obj.Close()
+
+	var prev backupIndex
+	if err := json.NewDecoder(bufio.NewReader(obj)).Decode(&prev); err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			lg.Info("No backup index found, making full backup")
+			return nil
+		}
+		return fmt.Errorf("failed to read backup index: %w", err)
+	}
+
+	if len(prev.Chain) == 0 {
+		a.warn(lg, "Backup index has no archives, making full backup")
+		return nil
+	}
+
+	// The chain consists of the full archive and the incremental ones.
+	if interval := a.config.Backup.FullInterval; interval != 0 && len(prev.Chain) > interval {
+		lg.Info("Enough incremental backups have been made, making full backup", "chain", len(prev.Chain))
+		return nil
+	}
+
+	a.prevIndex = &prev
+	lg.Info("Successfuly loaded backup index", "base", prev.Chain[len(prev.Chain)-1], "files", len(prev.Files))
+
+	return nil
+}
+
+// track records the entry in the index and reports whether it is unchanged since the previous backup,
+// in which case a regular file doesn't have to be archived again.
+func (a *Application) track(name string, info fs.FileInfo) (unchanged bool) {
+	entry := indexEntry{
+		ModTime: info.ModTime().UnixNano(),
+		Size:    info.Size(),
+	}
+	a.index.Files[name] = entry
+
+	if a.prevIndex == nil {
+		return false
+	}
+
+	prev, ok := a.prevIndex.Files[name]
+	return ok && prev == entry
+}
+
+// extendChain appends the archive to the chain of the previous backup,
+// or starts a new chain if the backup is full.
+func (a *Application) extendChain(name string) {
+	if a.prevIndex != nil {
+		a.index.Chain = slices.Clone(a.prevIndex.Chain)
+	}
+	a.index.Chain = append(a.index.Chain, name)
+}
+
+// writeDeleted writes the entry listing entries of the previous backup which are gone.
+func (a *Application) writeDeleted(tw *tar.Writer) (err error) {
+	var deleted []string
+	for name := range a.prevIndex.Files {
+		if _, ok := a.index.Files[name]; !ok {
+			deleted = append(deleted, name)
+		}
+	}
+	slices.Sort(deleted)
+
+	var b bytes.Buffer
+	for _, name := range deleted {
+		b.WriteString(name)
+		b.WriteByte('\n')
+	}
+
+	header := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       deletedName,
+		Size:       int64(b.Len()),
+		Mode:       0o600,
+		ModTime:    time.Now(),
+		PAXRecords: map[string]string{deletedPAXRecord: "true"},
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err = tw.Write(b.Bytes())
+	return err
+}
+
+// uploadIndex uploads the index of the backup, so that the next one can be based on it.
+func (a *Application) uploadIndex(ctx context.Context, dst *destination) (err error) {
+	key := a.indexKey(dst.config)
+
+	lg := log.FromContext(ctx)
+	lg.Info("Uploading backup index to S3", "index", key)
+
+	data, err := json.Marshal(a.index)
+	if err != nil {
+		return fmt.Errorf("failed to marshal backup index: %w", err)
+	}
+
+	if _, err := dst.client.PutObject(ctx,
+		dst.config.Bucket,
+		key,
+		bytes.NewReader(data),
+		int64(len(data)),
+		minio.PutObjectOptions{
+			StorageClass:         dst.config.StorageClass,
+			ContentType:          "application/json",
+			ServerSideEncryption: dst.encryption,
+		},
+	); err != nil {
+		return fmt.Errorf("failed to upload backup index to S3: %w", err)
+	}
+
+	lg.Info("Uploaded backup index to S3", "index", key, "chain", len(a.index.Chain))
+
+	return nil
+}
+
+// inChain reports whether the archive is in the chain of the current backup,
+// so that it must not be pruned.
+func (a *Application) inChain(name string) bool {
+	return a.index != nil && slices.Contains(a.index.Chain, name)
+}
+
+// baseArchive is a downloaded archive which the restored incremental archive is based on.
+type baseArchive struct {
+	name string
+	file *os.File
+}
+
+// resolveChain returns keys of the archives the archive is based on, oldest first.
+// It is empty for full archives.
+func (a *Application) resolveChain(ctx context.Context, dst *destination, key string) (keys []string, err error) {
+	var archives map[string]string
+	for {
+		info, err := dst.client.StatObject(ctx, dst.config.Bucket, key, minio.StatObjectOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat archive %s: %w", key, err)
+		}
+
+		parent := info.UserMetadata[parentMetadataKey]
+		if parent == "" {
+			break
+		}
+
+		if archives == nil {
+			list, err := a.listArchives(ctx, dst)
+			if err != nil {
+				return nil, err
+			}
+			archives = make(map[string]string, len(list))
+			for _, obj := range list {
+				archives[path.Base(obj.Key)] = obj.Key
+			}
+		}
+
+		parentKey, ok := archives[parent]
+		if !ok {
+			return nil, fmt.Errorf("archive %s is based on %s, which is not found", path.Base(key), parent)
+		}
+		if slices.Contains(keys, parentKey) {
+			return nil, fmt.Errorf("archive %s is based on itself", parent)
+		}
+		keys = append(keys, parentKey)
+		key = parentKey
+	}
+
+	slices.Reverse(keys)
+	return keys, nil
+}
+
+// extractBases extracts the archives the restored archive is based on, oldest first,
+// so that the restored archive is extracted on top of them.
+func (a *Application) extractBases(ctx context.Context) (err error) {
+	name, file := a.archiveName, a.archiveFile
+	defer func() {
+		a.archiveName, a.archiveFile = name, file
+	}()
+
+	for _, base := range a.baseArchives {
+		a.archiveName, a.archiveFile = base.name, base.file
+		if err := a.extract(ctx); err != nil {
+			return fmt.Errorf("%s: %w", base.name, err)
+		}
+	}
+
+	return nil
+}
+
+// removeBaseArchives removes the temporary files of the downloaded base archives.
+func (a *Application) removeBaseArchives() (err error) {
+	var errs []error
+	for _, base := range a.baseArchives {
+		base.file.Close()
+		if err := os.Remove(base.file.Name()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	a.baseArchives = nil
+	return errors.Join(errs...)
+}
+
+// removeDeleted removes entries listed in the entry the tar reader is positioned at.
+// resolve maps names of the entries to paths in the backup directories.
+func (a *Application) removeDeleted(r io.Reader, resolve func(name string) (target string, ok bool, err error)) (removed int, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		target, ok, err := resolve(scanner.Text())
+		if err != nil {
+			return removed, err
+		}
+		// The backup directories themselves are never removed.
+		if !ok || slices.ContainsFunc(a.config.Backup.Directories, func(dir string) bool {
+			return filepath.Clean(dir) == target
+		}) {
+			continue
+		}
+		if err := os.RemoveAll(target); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, scanner.Err()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// readTestArchive returns the contents of the regular files in the plain tar by their names,
+// and the names of the other entries with empty contents.
+func readTestArchive(t *testing.T, r io.Reader) map[string]string {
+	t.Helper()
+
+	entries := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[header.Name] = string(data)
+	}
+}
+
+// writeTestFile writes the file with the given modification time, creating its parents.
+func writeTestFile(t *testing.T, name, content string, modTime time.Time) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestIncremental(dir string) *Application {
+	a := &Application{
+		health: newHealth(time.Minute),
+		index:  &backupIndex{Files: make(map[string]indexEntry)},
+	}
+	a.config.Resource.Namespace = "default"
+	a.resources = []resource{parseResource("deployment/db")}
+	a.config.Backup.Directories = []string{dir}
+	a.config.Backup.Mode = "incremental"
+	a.config.Backup.FullInterval = 6
+	return a
+}
+
+func TestIncrementalArchive(t *testing.T) {
+	dir := t.TempDir()
+	before := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	writeTestFile(t, filepath.Join(dir, "same"), "same", before)
+	writeTestFile(t, filepath.Join(dir, "touched"), "touched", before)
+	writeTestFile(t, filepath.Join(dir, "resized"), "resized", before)
+	writeTestFile(t, filepath.Join(dir, "deleted"), "deleted", before)
+	writeTestFile(t, filepath.Join(dir, "sub", "deleted"), "deleted", before)
+
+	full := newTestIncremental(dir)
+	full.extendChain("full")
+
+	var b bytes.Buffer
+	if err := full.writeArchive(context.Background(), &b); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"deleted", "resized", "same", "sub/", "sub/deleted", "touched"}
+	if got := slices.Sorted(maps.Keys(readTestArchive(t, &b))); !slices.Equal(got, want) {
+		t.Fatalf("full archive has %v, want %v", got, want)
+	}
+
+	// Only the modification time changes.
+	writeTestFile(t, filepath.Join(dir, "touched"), "touched", before.Add(time.Minute))
+	// Only the size changes.
+	writeTestFile(t, filepath.Join(dir, "resized"), "resized!", before)
+	writeTestFile(t, filepath.Join(dir, "added"), "added", before)
+	for _, name := range []string{"deleted", "sub/deleted"} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	incr := newTestIncremental(dir)
+	incr.prevIndex = full.index
+	incr.extendChain("incr")
+
+	b.Reset()
+	if err := incr.writeArchive(context.Background(), &b); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readTestArchive(t, &b)
+
+	// Directories are always archived, so that their modes and times are restored.
+	want = []string{"added", deletedName, "resized", "sub/", "touched"}
+	if got := slices.Sorted(maps.Keys(entries)); !slices.Equal(got, want) {
+		t.Fatalf("incremental archive has %v, want %v", got, want)
+	}
+	if got, want := entries[deletedName], "deleted\nsub/deleted\n"; got != want {
+		t.Errorf("got deleted %q, want %q", got, want)
+	}
+	if got, want := entries["resized"], "resized!"; got != want {
+		t.Errorf("got resized %q, want %q", got, want)
+	}
+	if want := []string{"full", "incr"}; !slices.Equal(incr.index.Chain, want) {
+		t.Errorf("got chain %v, want %v", incr.index.Chain, want)
+	}
+	if _, ok := incr.index.Files["same"]; !ok {
+		t.Error("unchanged file isn't in the index")
+	}
+}
+
+func TestIndexUploadAndLoad(t *testing.T) {
+	tests := []struct {
+		name      string
+		chain     []string
+		wantBased bool
+	}{
+		{name: "no index"},
+		{name: "short chain", chain: []string{"full", "incr1"}, wantBased: true},
+		// After BACKUP_FULL_INTERVAL incremental backups, a full one is made.
+		{name: "chain at interval", chain: []string{"full", "incr1", "incr2"}},
+		{name: "empty chain", chain: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, s3 := newFakeS3(t)
+			dst.config.KeyPrefix = "backups/{namespace}/"
+
+			files := map[string]indexEntry{"data": {ModTime: 1, Size: 2}}
+
+			prev := newTestIncremental(t.TempDir())
+			if tt.chain != nil {
+				prev.index = &backupIndex{Chain: tt.chain, Files: files}
+				if err := prev.uploadIndex(context.Background(), dst); err != nil {
+					t.Fatal(err)
+				}
+				if got, want := s3.keys(""), []string{"backups/default/default.db.index.json"}; !slices.Equal(got, want) {
+					t.Fatalf("got objects %v, want %v", got, want)
+				}
+			}
+
+			a := newTestIncremental(t.TempDir())
+			a.config.Backup.FullInterval = 2
+			if err := a.loadIndex(context.Background(), dst); err != nil {
+				t.Fatal(err)
+			}
+
+			if !tt.wantBased {
+				if a.prevIndex != nil {
+					t.Fatalf("based on %v, want full backup", a.prevIndex.Chain)
+				}
+				return
+			}
+			if a.prevIndex == nil {
+				t.Fatal("making full backup")
+			}
+			if !slices.Equal(a.prevIndex.Chain, tt.chain) || !maps.Equal(a.prevIndex.Files, files) {
+				t.Fatalf("got index %+v", a.prevIndex)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Name of the archive entry describing the run which created the archive.
+const infoName = "backup-info.json"
+
+// PAX record marking the info entry,
+// so that restore can tell it apart from a file with the same name.
+const infoPAXRecord = "K8SBACKUP.info"
+
+type backupInfo struct {
+	Version     string               `json:"version"`
+	Time        time.Time            `json:"time"`
+	Hostname    string               `json:"hostname,omitempty"`
+	Cluster     string               `json:"cluster,omitempty"`
+	Namespace   string               `json:"namespace"`
+	Resources   []backupInfoResource `json:"resources"`
+	Directories []string             `json:"directories"`
+	Mode        string               `json:"mode"`
+	Files       int                  `json:"files"`
+	SizeBytes   int64                `json:"size_bytes"`
+}
+
+type backupInfoResource struct {
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Replicas *int   `json:"replicas,omitempty"` // before scaling down, if scaled
+}
+
+// writeInfo writes the entry with metadata of the run,
+// so that the archive can be understood without the object metadata.
+func (a *Application) writeInfo(tw *tar.Writer, stats *archiveStats) (err error) {
+	// The host name is the name of the pod in a cluster.
+	hostname, _ := os.Hostname()
+
+	info := backupInfo{
+		Version:     version,
+		Time:        a.startTime.UTC(),
+		Hostname:    hostname,
+		Cluster:     a.config.ClusterName,
+		Namespace:   a.config.Resource.Namespace,
+		Resources:   make([]backupInfoResource, len(a.resources)),
+		Directories: a.config.Backup.Directories,
+		Mode:        a.config.Backup.Mode,
+		Files:       stats.files,
+		SizeBytes:   stats.size,
+	}
+	for i := range a.resources {
+		res := &a.resources[i]
+		info.Resources[i] = backupInfoResource{
+			Kind:     res.Kind,
+			Name:     res.Name,
+			Replicas: res.Replicas,
+		}
+	}
+
+	data, err := json.MarshalIndent(&info, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	header := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       infoName,
+		Size:       int64(len(data)),
+		Mode:       0o600,
+		ModTime:    time.Now(),
+		PAXRecords: map[string]string{infoPAXRecord: "true"},
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err = tw.Write(data)
+	return err
+}
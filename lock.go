@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var errBackupInProgress = errors.New("backup already in progress")
+
+// lockName returns the name of the lease for the resources,
+// so that only runs backing up the same resources exclude each other.
+func (a *Application) lockName() string {
+	ids := slices.Clone(a.config.Resource.IDs)
+	slices.Sort(ids)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n%s", strings.Join(ids, ","), a.config.Resource.Selector, a.config.Resource.SelectorType)
+
+	return a.config.Lock.Prefix + "-" + hex.EncodeToString(hash.Sum(nil))[:10]
+}
+
+// lockHolder identifies the run in the lease.
+func lockHolder() string {
+	// The host name is the name of the pod in a cluster.
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// leaseExpired reports whether the holder of the lease has stopped renewing it, e.g. because it was killed.
+func leaseExpired(lease *coordinationv1.Lease) bool {
+	spec := &lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return time.Since(spec.RenewTime.Time) > time.Duration(*spec.LeaseDurationSeconds)*time.Second
+}
+
+// lock acquires the lease for the resources in their namespace, so that overlapping runs don't scale them at the same time.
+// The lease is renewed until unlock is called, and expires if the process dies without releasing it.
+func (a *Application) lock(ctx context.Context) (unlock func(), err error) {
+	name := a.lockName()
+	lg := log.FromContext(ctx).With("lease", name)
+	lg.Info("Trying to acquire lock")
+
+	leases := a.clientset.CoordinationV1().Leases(a.config.Resource.Namespace)
+	holder := lockHolder()
+	duration := time.Duration(a.config.Lock.Duration)
+	durationSeconds := int32(duration / time.Second)
+	now := metav1.NewMicroTime(time.Now())
+
+	lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		lease, err = leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &holder,
+				LeaseDurationSeconds: &durationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		// Another run has created it in the meantime.
+		if apierrors.IsAlreadyExists(err) {
+			return nil, errBackupInProgress
+		}
+	case err != nil:
+		return nil, fmt.Errorf("failed to get lease: %w", err)
+	case !leaseExpired(lease):
+		return nil, fmt.Errorf("%w: lock %s is held by %s since %s", errBackupInProgress,
+			name, *lease.Spec.HolderIdentity, lease.Spec.AcquireTime.Format(time.RFC3339))
+	default:
+		if prev := lease.Spec.HolderIdentity; prev != nil && *prev != "" {
+			a.warn(lg, "Taking over expired lock", "holder", *prev)
+		}
+		lease.Spec.HolderIdentity = &holder
+		lease.Spec.LeaseDurationSeconds = &durationSeconds
+		lease.Spec.AcquireTime = &now
+		lease.Spec.RenewTime = &now
+		lease, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+		// Another run has taken it over in the meantime.
+		if apierrors.IsConflict(err) {
+			return nil, errBackupInProgress
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire lease: %w", err)
+	}
+
+	lg.Info("Successfuly acquired lock", "holder", holder)
+
+	// Renewed independently of the backup, so that the lease is held while scaling back up after cancellation.
+	renewCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(duration / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-renewCtx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			now := metav1.NewMicroTime(time.Now())
+			lease.Spec.RenewTime = &now
+			renewed, err := leases.Update(renewCtx, lease, metav1.UpdateOptions{})
+			if err != nil {
+				if renewCtx.Err() == nil {
+					a.warn(lg, "Failed to renew lock", "error", err)
+				}
+				continue
+			}
+			lease = renewed
+		}
+	}()
+
+	unlock = func() {
+		cancel()
+		<-done
+
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), duration)
+		defer cancel()
+
+		// Only delete the lease if nobody has taken it over.
+		if err := leases.Delete(ctx, name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+		}); err != nil {
+			a.warn(lg, "Failed to release lock", "error", err)
+			return
+		}
+
+		lg.Info("Successfuly released lock")
+	}
+
+	return unlock, nil
+}
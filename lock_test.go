@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/infastin/gorack/xtypes"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestLock(cs *fake.Clientset) *Application {
+	a := &Application{clientset: cs}
+	a.config.Resource.IDs = []string{"deployment/db"}
+	a.config.Resource.Namespace = "default"
+	a.config.Lock = LockConfig{
+		Enabled:  true,
+		Prefix:   "k8s-backup",
+		Duration: xtypes.Duration(time.Minute),
+	}
+	return a
+}
+
+func TestLock(t *testing.T) {
+	ctx := context.Background()
+	cs := fake.NewClientset()
+	a := newTestLock(cs)
+	leases := cs.CoordinationV1().Leases("default")
+
+	unlock, err := a.lock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lease, err := leases.Get(ctx, a.lockName(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder := lease.Spec.HolderIdentity; holder == nil || *holder != lockHolder() {
+		t.Fatalf("lease is held by %v", holder)
+	}
+
+	// An overlapping run backing up the same resources.
+	if _, err := newTestLock(cs).lock(ctx); !errors.Is(err, errBackupInProgress) {
+		t.Fatalf("got %v, want %v", err, errBackupInProgress)
+	}
+
+	// Runs backing up other resources aren't excluded.
+	other := newTestLock(cs)
+	other.config.Resource.IDs = []string{"deployment/cache"}
+	unlockOther, err := other.lock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockOther()
+
+	unlock()
+
+	if _, err := leases.Get(ctx, a.lockName(), metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("lease isn't released: %v", err)
+	}
+
+	// The lock can be acquired again once released.
+	unlock, err = newTestLock(cs).lock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
+
+func TestLockTakesOverExpiredLease(t *testing.T) {
+	ctx := context.Background()
+
+	holder := "killed-1"
+	duration := int32(60)
+	renewed := metav1.NewMicroTime(time.Now().Add(-time.Hour))
+
+	a := newTestLock(fake.NewClientset())
+	cs := fake.NewClientset(&coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: a.lockName(), Namespace: "default"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			AcquireTime:          &renewed,
+			RenewTime:            &renewed,
+		},
+	})
+	a.clientset = cs
+
+	unlock, err := a.lock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	lease, err := cs.CoordinationV1().Leases("default").Get(ctx, a.lockName(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *lease.Spec.HolderIdentity != lockHolder() {
+		t.Fatalf("lease is held by %s", *lease.Spec.HolderIdentity)
+	}
+	if len(a.warnings) != 1 {
+		t.Fatalf("got warnings %v, want the takeover one", a.warnings)
+	}
+}
@@ -2,461 +2,3093 @@ package main
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net/http"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
+	_ "time/tzdata" // the image has no time zone database
 
-	"github.com/caarlos0/env/v11"
 	"github.com/charmbracelet/log"
 	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/infastin/gorack/errdefer"
+	"github.com/klauspost/pgzip"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
 )
 
+type resource struct {
+	ID   string // TYPE/NAME as specified in config
+	Type string // e.g. deployments
+	Kind string // e.g. Deployment
+	Name string
+	// Number of replicas before scaling down,
+	// nil if the resource was not scaled or can't be scaled.
+	Replicas *int
+	// Whether the resource was already scaled down to zero,
+	// so that there is nothing to wait for or to scale back up.
+	Idle bool
+}
+
+func parseResource(id string) resource {
+	parts := strings.SplitN(id, "/", 2)
+	res := resource{ID: id, Name: parts[1]}
+	switch parts[0] {
+	case "deployment", "deployments":
+		res.Type = "deployments"
+		res.Kind = "Deployment"
+	case "statefulset", "statefulsets":
+		res.Type = "statefulsets"
+		res.Kind = "StatefulSet"
+	case "replicaset", "replicasets":
+		res.Type = "replicasets"
+		res.Kind = "ReplicaSet"
+	case "daemonset", "daemonsets":
+		res.Type = "daemonsets"
+		res.Kind = "DaemonSet"
+	case "cronjob", "cronjobs":
+		res.Type = "cronjobs"
+		res.Kind = "CronJob"
+	default:
+		// Custom resource, its kind is discovered.
+		res.Type = parts[0]
+	}
+	return res
+}
+
 type Application struct {
-	clientset    *kubernetes.Clientset
-	resourceType string
-	resourceKind string
-	resourceName string
-	config       Config
-	tgBot        *tgbotapi.BotAPI
-	s3Client     *minio.Client
-	lg           *log.Logger
-	logData      *bytes.Buffer
-	archiveName  string
-	archiveFile  *os.File
-	archiveSize  int64
+	clientset       kubernetes.Interface
+	dynamicClient   dynamic.Interface // for resources without typed clients, e.g. volume snapshots and custom resources
+	restConfig      *rest.Config
+	resources       []resource
+	config          Config
+	tgBot           *tgbotapi.BotAPI
+	tgTemplate      *template.Template
+	destinations    []*destination
+	fsDest          *fsDestination
+	lg              *log.Logger
+	logData         *bytes.Buffer
+	archiveName     string
+	archiveFile     *os.File
+	archiveSize     int64
+	archiveChecksum string
+	contentChecksum string           // of the directory entries only, if BACKUP_WARN_UNCHANGED is set
+	checksums       *checksumHistory // content checksums of the previous archives, if loaded
+	archiveEntries  int
+	index           *backupIndex // index of the incremental backup being made
+	prevIndex       *backupIndex // index of the backup the incremental one is based on
+	baseArchives    []baseArchive
+	snapshotID      string // NAMESPACE/NAME of the created volume snapshot
+	child           bool   // backs up one of the resources backed up separately
+	resourceResults []resourceResult
+	warnings        []string // collected during the run for notifications
+	warningsMu      sync.Mutex
+	tgFailed        bool // the Telegram notification couldn't be sent
+	startTime       time.Time
+	duration        time.Duration
+	metrics         *metrics
+	health          *health
+	manifest        []byte
+	location        *time.Location
+	archiveRegexp   *regexp.Regexp
+}
+
+// destination is a bucket the archive is uploaded to.
+type destination struct {
+	config      *S3Config
+	client      *minio.Client
+	encryption  encrypt.ServerSide
+	archiveKey  string
+	downloadURL string // presigned URL of the archive, if enabled
+	err         error  // error of the upload, if it has failed
+}
+
+func newDestination(config *S3Config) (dst *destination, err error) {
+	dst = &destination{config: config}
+
+	var creds *credentials.Credentials
+	switch config.CredentialsMode {
+	case "static":
+		creds = credentials.NewStaticV4(config.AccessKeyID, config.SecretAccessKey, "")
+	case "iam":
+		// Covers EC2 instance profiles, ECS task roles and EKS IRSA.
+		creds = credentials.NewIAM("")
+	case "env":
+		creds = credentials.NewEnvAWS()
+	case "chain":
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		})
+	}
+
+	endpoint, secure := config.EndpointHost()
+
+	var transport http.RoundTripper
+	if config.CACert != "" || config.InsecureSkipVerify {
+		tr, err := minio.DefaultTransport(secure)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create S3 transport: %w", err)
+		}
+		if tr.TLSClientConfig == nil {
+			tr.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		if config.CACert != "" {
+			tr.TLSClientConfig.RootCAs, err = config.CACertPool()
+			if err != nil {
+				return nil, fmt.Errorf("failed to load S3 CA certificate: %w", err)
+			}
+		}
+		tr.TLSClientConfig.InsecureSkipVerify = config.InsecureSkipVerify
+		transport = tr
+	}
+
+	dst.client, err = minio.New(endpoint, &minio.Options{
+		Creds:     creds,
+		Secure:    secure,
+		Region:    config.Region,
+		Transport: transport,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	switch config.SSE {
+	case "s3":
+		dst.encryption = encrypt.NewSSE()
+	case "kms":
+		dst.encryption, err = encrypt.NewSSEKMS(config.SSEKMSKeyID, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create S3 server-side encryption: %w", err)
+		}
+	}
+
+	return dst, nil
+}
+
+var errS3Timeout = errors.New("S3 timeout exceeded")
+
+// withTimeout calls fn with the context limited by the S3 timeout of the destination, if it is set,
+// so that a slow endpoint doesn't consume the whole backup timeout.
+func (d *destination) withTimeout(ctx context.Context, fn func(context.Context) error) (err error) {
+	if d.config.Timeout == 0 {
+		return fn(ctx)
+	}
+
+	timeout := time.Duration(d.config.Timeout)
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, errS3Timeout)
+	defer cancel()
+
+	err = fn(ctx)
+	if err != nil && errors.Is(context.Cause(ctx), errS3Timeout) {
+		return fmt.Errorf("%w (%s): %w", errS3Timeout, timeout, err)
+	}
+
+	return err
+}
+
+// String returns the endpoint and the bucket of the destination.
+func (d *destination) String() string {
+	endpoint, _ := d.config.EndpointHost()
+	return endpoint + "/" + d.config.Bucket
+}
+
+// storageClass returns the storage class archives are uploaded with.
+// The bucket's default one is used if it isn't set, which is STANDARD for AWS S3.
+func (d *destination) storageClass() string {
+	if d.config.StorageClass == "" {
+		return "default"
+	}
+	return d.config.StorageClass
+}
+
+func NewApplication() (app *Application, err error) {
+	app = new(Application)
+
+	if err := app.config.Load(); err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	app.config.Resource.Normalize()
+	app.config.Backup.Normalize()
+	app.config.S3.Normalize()
+	for i := range app.config.S3Mirrors {
+		app.config.S3Mirrors[i].Normalize()
+	}
+	app.config.Telegram.Normalize()
+
+	if err := app.config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	app.restConfig, err = app.kubeConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain k8s config: %w", err)
+	}
+
+	app.clientset, err = kubernetes.NewForConfig(app.restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes clientset: %w", err)
+	}
+
+	if app.config.Snapshot.PVC != "" || app.config.Resource.APIGroup != "" {
+		app.dynamicClient, err = dynamic.NewForConfig(app.restConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create kubernetes dynamic client: %w", err)
+		}
+	}
+
+	if app.config.Telegram.BotToken != "" {
+		app.tgBot, err = tgbotapi.NewBotAPI(app.config.Telegram.BotToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Telegram Bot API: %w", err)
+		}
+		if app.config.Telegram.Template != "" {
+			app.tgTemplate, err = parseTelegramTemplate(app.config.Telegram.Template, app.config.Telegram.ParseMode)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse Telegram template: %w", err)
+			}
+		}
+	}
+
+	app.health = newHealth(time.Duration(app.config.Health.ProgressTimeout))
+
+	if app.config.DestType == "fs" {
+		app.fsDest = &fsDestination{
+			dir:      app.config.FS.Path,
+			progress: app.health,
+		}
+	} else {
+		// The primary destination goes first, restore uses only it.
+		primary, err := newDestination(&app.config.S3)
+		if err != nil {
+			return nil, err
+		}
+		app.destinations = append(app.destinations, primary)
+
+		for i := range app.config.S3Mirrors {
+			mirror, err := newDestination(&app.config.S3Mirrors[i])
+			if err != nil {
+				return nil, fmt.Errorf("mirror %d: %w", i, err)
+			}
+			app.destinations = append(app.destinations, mirror)
+		}
+	}
+
+	app.resources = make([]resource, len(app.config.Resource.IDs))
+	for i, id := range app.config.Resource.IDs {
+		app.resources[i] = parseResource(id)
+	}
+
+	if app.config.Resource.Selector != "" {
+		if err := app.selectResources(); err != nil {
+			return nil, fmt.Errorf("failed to select resources: %w", err)
+		}
+	}
+
+	if app.customResources() {
+		if err := app.discoverCustomResources(); err != nil {
+			return nil, err
+		}
+	}
+
+	app.metrics = &metrics{
+		resource:  strings.Join(app.config.Resource.IDs, ","),
+		namespace: app.config.Resource.Namespace,
+	}
+
+	app.location = time.Local
+	if app.config.Backup.Timezone != "" {
+		app.location, err = time.LoadLocation(app.config.Backup.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load timezone: %w", err)
+		}
+	}
+
+	app.archiveRegexp = app.archiveNameRegexp()
+
+	app.setupLogger()
+
+	app.lg.Info("Starting k8s-backup", "version", version, "commit", commit, "build_date", buildDate)
+
+	return app, nil
+}
+
+// setupLogger creates the logger, which also writes to the buffer sent in notifications.
+func (a *Application) setupLogger() {
+	a.logData = new(bytes.Buffer)
+	a.lg = log.NewWithOptions(io.MultiWriter(os.Stdout, a.logData), log.Options{
+		ReportTimestamp: true,
+		Formatter:       log.TextFormatter,
+	})
+	if a.config.ClusterName != "" {
+		a.lg = a.lg.With("cluster", a.config.ClusterName)
+	}
+	if a.config.NodeName != "" {
+		a.lg = a.lg.With("node", a.config.NodeName)
+	}
+}
+
+// kubeConfig returns the config from KUBECONFIG, if it is set,
+// otherwise the in-cluster config, falling back to ~/.kube/config
+// when running outside of a cluster.
+func (a *Application) kubeConfig() (config *rest.Config, err error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if a.config.Kubeconfig != "" {
+		rules.ExplicitPath = a.config.Kubeconfig
+	} else {
+		config, err = rest.InClusterConfig()
+		if !errors.Is(err, rest.ErrNotInCluster) {
+			return config, err
+		}
+	}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+}
+
+func (a *Application) Run(ctx context.Context) (err error) {
+	a.startTime = time.Now()
+	defer func() {
+		a.duration = time.Since(a.startTime)
+		a.lg.Info("Finished backup", "duration", humanizeDuration(a.duration))
+
+		// The outcome is reported by the parent along with the other resources.
+		if a.child {
+			a.record(err)
+			return
+		}
+
+		a.health.setPhase("finished")
+
+		a.metrics.update(err == nil, a.archiveSize, a.duration)
+		if a.config.Metrics.PushgatewayURL != "" {
+			if err := a.pushMetrics(); err != nil {
+				a.warn(a.lg, "Failed to push metrics", "error", err)
+			}
+		}
+
+		// Each resource has been recorded when backed up separately.
+		if !a.separately() {
+			a.record(err)
+		}
+		if a.config.ResultFile != "" {
+			if err := a.writeResultFile(a.result(err)); err != nil {
+				a.lg.Error("Failed to write result file", "error", err)
+			}
+		}
+		a.notify(err)
+	}()
+
+	if a.config.Metrics.Addr != "" {
+		a.serveMetrics()
+	}
+
+	// Resources backed up separately are covered by the lock of the parent.
+	if a.config.Lock.Enabled && !a.child && !a.config.DryRun {
+		unlock, err := a.lock(log.WithContext(ctx, a.lg))
+		if err != nil {
+			a.lg.Error("Failed to acquire lock", "error", err)
+			return err
+		}
+		defer unlock()
+	}
+
+	if a.separately() {
+		return a.runSeparately(ctx)
+	}
+
+	lg := a.lg.With(
+		"resources", a.config.Resource.IDs,
+		"namespace", a.config.Resource.Namespace,
+	)
+
+	if a.config.DryRun {
+		lg.Warn("Running in dry run mode: nothing will be scaled or uploaded")
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, time.Duration(a.config.Backup.Timeout))
+	defer cancel()
+
+	if a.config.Hook.PreCommand != "" {
+		lg := a.lg.With("hook", "pre_command")
+		ctx := log.WithContext(runCtx, lg)
+		a.health.setPhase("pre_command")
+
+		if err := a.commandHook(ctx, a.config.Hook.PreCommand); err != nil {
+			lg.Error("Failed to run pre-backup command", "error", err)
+			return fmt.Errorf("failed to run pre-backup command: %w", err)
+		}
+	}
+
+	if a.config.Hook.PostCommand != "" {
+		// Deferred before scaling down, so that it runs after scaling up.
+		defer func() {
+			lg := a.lg.With("hook", "post_command")
+			a.health.setPhase("post_command")
+
+			ctx := log.WithContext(context.WithoutCancel(runCtx), lg)
+			ctx, cancel := context.WithTimeout(ctx, time.Duration(a.config.Hook.Timeout))
+			defer cancel()
+
+			if hookErr := a.commandHook(ctx, a.config.Hook.PostCommand); hookErr != nil {
+				lg.Error("Failed to run post-backup command", "error", hookErr)
+				hookErr = fmt.Errorf("failed to run post-backup command: %w", hookErr)
+				if err != nil {
+					err = fmt.Errorf("%w: %w", err, hookErr)
+				} else {
+					err = hookErr
+				}
+			}
+		}()
+	}
+
+	// Check directories before scaling down to avoid needless downtime.
+	a.health.setPhase("checking")
+	if err := a.checkDirectories(log.WithContext(runCtx, a.lg)); err != nil {
+		a.lg.Error("Failed to check directories", "error", err)
+		return fmt.Errorf("failed to check directories: %w", err)
+	}
+
+	// The same goes for buckets, which are used only after the workload has been scaled down.
+	for _, dst := range a.destinations {
+		lg := a.lg.With(
+			"endpoint", dst.config.Endpoint,
+			"bucket", dst.config.Bucket,
+		)
+		ctx := log.WithContext(runCtx, lg)
+
+		if err := a.checkBucket(ctx, dst); err != nil {
+			lg.Error("Failed to check bucket", "error", err)
+			return fmt.Errorf("failed to check bucket %s: %w", dst.config.Bucket, err)
+		}
+	}
+
+	if a.config.Backup.Mode == "incremental" {
+		dst := a.destinations[0]
+		lg := a.lg.With(
+			"endpoint", dst.config.Endpoint,
+			"bucket", dst.config.Bucket,
+		)
+		ctx := log.WithContext(runCtx, lg)
+
+		if err := dst.withTimeout(ctx, func(ctx context.Context) error {
+			return a.loadIndex(ctx, dst)
+		}); err != nil {
+			lg.Error("Failed to load backup index", "error", err)
+			return fmt.Errorf("failed to load backup index: %w", err)
+		}
+	}
+
+	ctx = log.WithContext(runCtx, lg)
+
+	if a.config.Backup.IncludeManifest {
+		if err := a.fetchManifest(ctx); err != nil {
+			lg.Error("Failed to fetch manifest", "error", err)
+			return fmt.Errorf("failed to fetch manifest: %w", err)
+		}
+	}
+
+	// Set to nil once the resources have been scaled up, e.g. after copying the directories.
+	var scaleUp func(context.Context) error
+
+	if a.config.Resource.SkipScale {
+		lg.Info("Skipping scaling")
+	} else if a.config.Backup.QuiesceMode == "fsfreeze" {
+		lg.Info("Skipping scaling, file systems will be frozen instead")
+	} else {
+		start := time.Now()
+		a.health.setPhase("scaling_down")
+
+		scaleUp, err = a.scaleDown(ctx)
+		if err != nil {
+			lg.Error("Failed to scale down", "error", err)
+			return fmt.Errorf("failed to scale down: %w", err)
+		}
+
+		lg.Info("Finished scaling down", "duration", humanizeDuration(time.Since(start)))
+		defer func() {
+			if scaleUp == nil {
+				return
+			}
+			if scaleErr := a.scaleUp(scaleUp); scaleErr != nil {
+				if err != nil {
+					err = fmt.Errorf("%w: %w", err, scaleErr)
+				} else {
+					err = scaleErr
+				}
+			}
+		}()
+
+		// Storage may still be flushing or detaching volumes after the pods are gone.
+		if delay := time.Duration(a.config.Backup.PostScaleDelay); delay != 0 && !a.config.DryRun {
+			a.health.setPhase("post_scale_delay")
+			lg.Info("Waiting before archiving", "delay", delay)
+
+			select {
+			case <-ctx.Done():
+				lg.Error("Cancelled while waiting before archiving", "error", ctx.Err())
+				return fmt.Errorf("cancelled while waiting before archiving: %w", ctx.Err())
+			case <-time.After(delay):
+			}
+		}
+	}
+
+	if a.config.Hook.PreExec != "" {
+		lg := a.lg.With("hook", "pre_exec")
+		ctx := log.WithContext(runCtx, lg)
+		a.health.setPhase("pre_exec")
+
+		if err := a.execHook(ctx, a.config.Hook.PreExec); err != nil {
+			lg.Error("Failed to run pre-backup hook", "error", err)
+			return fmt.Errorf("failed to run pre-backup hook: %w", err)
+		}
+	}
+
+	if a.config.Hook.PostExec != "" {
+		defer func() {
+			lg := a.lg.With("hook", "post_exec")
+			a.health.setPhase("post_exec")
+
+			// Run the hook even if the backup has been cancelled,
+			// since it usually brings the workload back to normal.
+			ctx := log.WithContext(context.WithoutCancel(runCtx), lg)
+			ctx, cancel := context.WithTimeout(ctx, time.Duration(a.config.Hook.Timeout))
+			defer cancel()
+
+			if hookErr := a.execHook(ctx, a.config.Hook.PostExec); hookErr != nil {
+				lg.Error("Failed to run post-backup hook", "error", hookErr)
+				hookErr = fmt.Errorf("failed to run post-backup hook: %w", hookErr)
+				if err != nil {
+					err = fmt.Errorf("%w: %w", err, hookErr)
+				} else {
+					err = hookErr
+				}
+			}
+		}()
+	}
+
+	if a.config.Snapshot.PVC != "" {
+		lg := lg.With("pvc", a.config.Snapshot.PVC)
+		ctx := log.WithContext(runCtx, lg)
+
+		start := time.Now()
+		a.health.setPhase("snapshotting")
+
+		if err := a.snapshot(ctx); err != nil {
+			lg.Error("Failed to snapshot volume", "error", err)
+			return fmt.Errorf("failed to snapshot volume: %w", err)
+		}
+
+		lg.Info("Finished snapshotting", "duration", humanizeDuration(time.Since(start)))
+	}
+
+	if a.config.Backup.CopyFirst && !a.config.DryRun {
+		lg := a.lg.With("directories", a.config.Backup.Directories)
+		ctx := log.WithContext(runCtx, lg)
+
+		start := time.Now()
+		a.health.setPhase("copying")
+
+		dirs, cleanup, err := a.copyDirectories(ctx)
+		if err != nil {
+			lg.Error("Failed to copy directories", "error", err)
+			return fmt.Errorf("failed to copy directories: %w", err)
+		}
+
+		lg.Info("Finished copying", "duration", humanizeDuration(time.Since(start)))
+
+		orig := a.config.Backup.Directories
+		a.config.Backup.Directories = dirs
+		defer func() {
+			a.config.Backup.Directories = orig
+			if err := cleanup(); err != nil {
+				a.warn(a.lg, "Failed to delete copied directories", "error", err)
+			}
+		}()
+
+		// The copies are archived, so the workload doesn't have to wait for that.
+		err = a.scaleUp(scaleUp)
+		scaleUp = nil
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.config.Backup.Stream && !a.config.DryRun {
+		lg = a.lg.With(
+			"directories", a.config.Backup.Directories,
+			"endpoint", a.config.S3.Endpoint,
+			"bucket", a.config.S3.Bucket,
+		)
+		ctx = log.WithContext(runCtx, lg)
+
+		start := time.Now()
+		a.health.setPhase("streaming")
+
+		if err := a.stream(ctx); err != nil {
+			lg.Error("Failed to stream to S3", "error", err)
+			return fmt.Errorf("failed to stream to S3: %w", err)
+		}
+
+		lg.Info("Finished streaming", "duration", humanizeDuration(time.Since(start)))
+	} else if err := a.archiveAndUpload(runCtx); err != nil {
+		return err
+	}
+
+	for _, dst := range a.destinations {
+		// Old archives are kept where the new one is missing.
+		if dst.err != nil || (dst.config.RetentionDays == 0 && dst.config.RetentionCount == 0) {
+			continue
+		}
+
+		lg = a.lg.With(
+			"endpoint", dst.config.Endpoint,
+			"bucket", dst.config.Bucket,
+		)
+		ctx = log.WithContext(runCtx, lg)
+		a.health.setPhase("pruning")
+
+		if err := dst.withTimeout(ctx, func(ctx context.Context) error {
+			return a.prune(ctx, dst)
+		}); err != nil {
+			a.warn(lg, "Failed to prune old archives", "error", err)
+		}
+	}
+
+	return nil
+}
+
+// storeLocally stores the archive in the directory of the fs destination.
+func (a *Application) storeLocally(runCtx context.Context) (err error) {
+	lg := a.lg.With(
+		"path", a.fsDest.dir,
+		"name", a.archiveName,
+	)
+
+	if a.config.DryRun {
+		lg.Info("Dry run: skipping storing archive")
+		return nil
+	}
+
+	ctx := log.WithContext(runCtx, lg)
+
+	start := time.Now()
+	a.health.setPhase("storing")
+
+	lg.Info("Storing archive")
+
+	if err := a.storeArchive(ctx, a.fsDest, a.archiveName); err != nil {
+		lg.Error("Failed to store archive", "error", err)
+		return fmt.Errorf("failed to store archive: %w", err)
+	}
+
+	lg.Info("Finished storing", "duration", humanizeDuration(time.Since(start)))
+
+	return nil
+}
+
+// checkBucket checks that the bucket exists and creates it if S3_CREATE_BUCKET is set.
+func (a *Application) checkBucket(ctx context.Context, dst *destination) (err error) {
+	lg := log.FromContext(ctx)
+	lg.Info("Trying to check bucket")
+
+	exists, err := dst.client.BucketExists(ctx, dst.config.Bucket)
+	if minio.ToErrorResponse(err).Code == "AccessDenied" {
+		// Credentials might be allowed to put objects only.
+		a.warn(lg, "Not allowed to check bucket, skipping")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		lg.Info("Bucket exists")
+		if dst.config.LockMode != "" {
+			return a.checkObjectLock(ctx, dst)
+		}
+		return nil
+	}
+
+	if !dst.config.CreateBucket {
+		return errors.New("bucket does not exist, set S3_CREATE_BUCKET to create it")
+	}
+
+	if a.config.DryRun {
+		lg.Info("Dry run: skipping creating bucket")
+		return nil
+	}
+
+	lg.Info("Trying to create bucket")
+
+	if err := dst.client.MakeBucket(ctx, dst.config.Bucket, minio.MakeBucketOptions{
+		Region:        dst.config.Region,
+		ObjectLocking: dst.config.LockMode != "",
+	}); err != nil {
+		return fmt.Errorf("failed to create bucket: %w", err)
+	}
+
+	lg.Info("Successfuly created bucket")
+
+	return nil
+}
+
+// checkObjectLock checks that the bucket has object lock enabled,
+// since uploads with retention settings are rejected otherwise.
+func (a *Application) checkObjectLock(ctx context.Context, dst *destination) (err error) {
+	lg := log.FromContext(ctx)
+	lg.Info("Trying to check bucket object lock")
+
+	enabled, _, _, _, err := dst.client.GetObjectLockConfig(ctx, dst.config.Bucket)
+	switch minio.ToErrorResponse(err).Code {
+	case "AccessDenied":
+		a.warn(lg, "Not allowed to check bucket object lock, skipping")
+		return nil
+	case "ObjectLockConfigurationNotFoundError":
+		enabled = ""
+	default:
+		if err != nil {
+			return fmt.Errorf("failed to get bucket object lock configuration: %w", err)
+		}
+	}
+
+	if enabled != "Enabled" {
+		return errors.New("bucket doesn't have object lock enabled, which is required by S3_LOCK_MODE")
+	}
+
+	lg.Info("Bucket has object lock enabled")
+
+	return nil
+}
+
+// archiveAndUpload creates the archive in a temporary file and then uploads it to S3.
+func (a *Application) archiveAndUpload(runCtx context.Context) (err error) {
+	lg := a.lg.With("directories", a.config.Backup.Directories)
+	ctx := log.WithContext(runCtx, lg)
+
+	start := time.Now()
+	a.health.setPhase("archiving")
+
+	archive := a.archive
+	if a.config.Backup.QuiesceMode == "fsfreeze" {
+		archive = func(ctx context.Context) error {
+			return a.withFrozen(ctx, a.archive)
+		}
+	}
+
+	if err := archive(ctx); err != nil {
+		lg.Error("Failed to archive", "error", err)
+		return fmt.Errorf("failed to archive: %w", err)
+	}
+
+	lg.Info("Finished archiving", "duration", humanizeDuration(time.Since(start)))
+	defer func() {
+		// There is no temporary file in dry runs, nor when streaming or deduplicating.
+		if a.archiveFile == nil {
+			if a.config.DryRun {
+				a.lg.Info("Dry run: skipping deletion of temporary archive file")
+			}
+			return
+		}
+		a.archiveFile.Close()
+		if err := os.Remove(a.archiveFile.Name()); err != nil {
+			a.warn(a.lg, "Failed to delete temporary archive file", "error", err)
+		}
+	}()
+
+	// Don't waste time uploading a broken archive, e.g. truncated because the disk is full.
+	if a.config.Backup.Verify && a.archiveFile != nil {
+		start := time.Now()
+		a.health.setPhase("verifying")
+
+		if err := a.verifyArchive(ctx); err != nil {
+			lg.Error("Failed to verify archive", "error", err)
+			return fmt.Errorf("failed to verify archive: %w", err)
+		}
+
+		lg.Info("Finished verifying", "duration", humanizeDuration(time.Since(start)))
+	}
+
+	if a.fsDest != nil {
+		return a.storeLocally(runCtx)
+	}
+
+	// Compared before uploading, so that the previous archive is the latest one.
+	if a.config.Backup.WarnUnchanged {
+		dst := a.destinations[0]
+		ctx := log.WithContext(runCtx, a.lg.With("bucket", dst.config.Bucket))
+		if err := dst.withTimeout(ctx, func(ctx context.Context) error {
+			return a.checkUnchanged(ctx, dst)
+		}); err != nil {
+			a.warn(a.lg, "Failed to compare archive with the previous one", "error", err)
+		}
+	}
+
+	for _, dst := range a.destinations {
+		lg := a.lg.With(
+			"endpoint", dst.config.Endpoint,
+			"bucket", dst.config.Bucket,
+			"key", dst.archiveKey,
+		)
+		if a.archiveFile != nil {
+			lg = lg.With("file", a.archiveFile.Name())
+		}
+		ctx := log.WithContext(runCtx, lg)
+
+		start := time.Now()
+		a.health.setPhase("uploading")
+
+		dst.err = dst.withTimeout(ctx, func(ctx context.Context) error {
+			return a.upload(ctx, dst)
+		})
+		if dst.err != nil {
+			lg.Error("Failed to upload to S3", "error", dst.err)
+			continue
+		}
+
+		lg.Info("Finished uploading", "duration", humanizeDuration(time.Since(start)))
+	}
+
+	// The backup fails only if the archive hasn't been uploaded anywhere.
+	var errs []error
+	for _, dst := range a.destinations {
+		if dst.err == nil {
+			return nil
+		}
+		errs = append(errs, dst.err)
+	}
+
+	return fmt.Errorf("failed to upload to S3: %w", errors.Join(errs...))
+}
+
+func (a *Application) checkDirectories(ctx context.Context) (err error) {
+	lg := log.FromContext(ctx)
+
+	for _, dir := range a.config.Backup.Directories {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+
+		empty, err := isEmptyDir(dir)
+		if err != nil {
+			return err
+		}
+		if empty {
+			if !a.config.Backup.AllowEmpty {
+				return fmt.Errorf("%s is empty", dir)
+			}
+			a.warn(lg, "Directory is empty", "directory", dir)
+		}
+	}
+
+	if a.config.Backup.CheckFreeSpace && !a.config.DryRun {
+		if err := a.checkFreeSpace(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkFreeSpace fails if the temporary directory obviously doesn't have enough space for the archive
+// and the copies of the directories, if any, i.e. less than the size of the backup directories for each,
+// so that archiving doesn't fail after scaling down.
+func (a *Application) checkFreeSpace(ctx context.Context) (err error) {
+	lg := log.FromContext(ctx)
+
+	// Nothing is archived into the temporary directory when streaming,
+	// and incremental archives usually contain just a fraction of the files.
+	copies := 0
+	if !a.config.Backup.Stream && a.config.Backup.Mode != "incremental" {
+		copies++
+	}
+	if a.config.Backup.CopyFirst {
+		copies++
+	}
+	if copies == 0 {
+		return nil
+	}
+
+	tempDir := a.config.Backup.TempDirectory()
+	free, err := freeSpace(tempDir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get free space of %s: %w", tempDir, err)
+	}
+
+	var size int64
+	for _, dir := range a.config.Backup.Directories {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get size of %s: %w", dir, err)
+		}
+	}
+
+	required := size * int64(copies)
+	lg.Info("Checked free space", "directory", tempDir, "free", byteCountIEC(free), "required", byteCountIEC(required))
+
+	if free < required {
+		return fmt.Errorf("not enough free space in %s: %s is free, but %s is required",
+			tempDir, byteCountIEC(free), byteCountIEC(required))
+	}
+
+	return nil
+}
+
+func isEmptyDir(dir string) (empty bool, err error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	if _, err := file.Readdirnames(1); err != nil {
+		if errors.Is(err, io.EOF) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	return false, nil
+}
+
+// scaleUp runs undo returned by scaleDown.
+// It doesn't depend on the run context,
+// so that the workload is scaled back up even if the context has been cancelled.
+func (a *Application) scaleUp(undo func(context.Context) error) (err error) {
+	lg := a.lg.With(
+		"resources", a.config.Resource.IDs,
+		"namespace", a.config.Resource.Namespace,
+	)
+
+	ctx := log.WithContext(context.Background(), lg)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(a.config.ScaleUpTimeout))
+	defer cancel()
+
+	start := time.Now()
+	a.health.setPhase("scaling_up")
+
+	if err := undo(ctx); err != nil {
+		lg.Error("Failed to scale up", "error", err)
+		return fmt.Errorf("failed to scale up: %w", err)
+	}
+
+	lg.Info("Finished scaling up", "duration", humanizeDuration(time.Since(start)))
+
+	return nil
+}
+
+// Delay before the first scale up retry, doubled after each retry.
+const scaleUpBackoff = time.Second
+
+// retryScaleUp calls fn until it succeeds or RESOURCE_SCALEUP_RETRIES retries are exhausted.
+// attempt is zero on the first call; on retries fn must re-read the current state,
+// so that it doesn't override changes made by someone else in the meantime.
+func (a *Application) retryScaleUp(ctx context.Context, fn func(ctx context.Context, attempt int) error) (err error) {
+	lg := log.FromContext(ctx)
+	backoff := scaleUpBackoff
+
+	for attempt := 0; ; attempt++ {
+		err = fn(ctx, attempt)
+		if err == nil || attempt == a.config.Resource.ScaleUpRetries {
+			return err
+		}
+
+		lg.Warn("Failed to scale up, retrying",
+			"attempt", attempt+1,
+			"backoff", backoff,
+			"error", err,
+		)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+	}
+}
+
+// retryK8s calls fn until it succeeds, fails with an error that isn't transient
+// or K8S_MAX_RETRIES retries are exhausted.
+// fn must be safe to repeat, e.g. a get or a patch.
+func (a *Application) retryK8s(ctx context.Context, fn func() error) (err error) {
+	lg := log.FromContext(ctx)
+
+	backoff := wait.Backoff{
+		Duration: k8sBackoff,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    a.config.K8sMaxRetries + 1,
+	}
+
+	attempt := 0
+	return retry.OnError(backoff, func(err error) bool {
+		if ctx.Err() != nil || !isTransientK8sError(err) {
+			return false
+		}
+		attempt++
+		if attempt < backoff.Steps {
+			lg.Warn("Kubernetes API request failed, retrying", "attempt", attempt, "error", err)
+		}
+		return true
+	}, fn)
+}
+
+// Delay before the first Kubernetes API retry, doubled after each retry.
+var k8sBackoff = 500 * time.Millisecond
+
+// isTransientK8sError reports whether the request may succeed if repeated,
+// e.g. when the API server is restarting or etcd is electing a new leader.
+func isTransientK8sError(err error) bool {
+	return apierrors.IsConflict(err) ||
+		apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsInternalError(err) ||
+		utilnet.IsConnectionRefused(err) ||
+		utilnet.IsConnectionReset(err) ||
+		utilnet.IsProbableEOF(err) ||
+		utilnet.IsHTTP2ConnectionLost(err)
+}
+
+// getPodTemplateHash returns the pod template hash of the current replicaset owned by the resource.
+// Standalone replicasets are fetched by name in wait instead.
+func (a *Application) getPodTemplateHash(ctx context.Context, res *resource) (hash string, err error) {
+	lg := log.FromContext(ctx)
+	lg.Info("Trying to get pod template hash")
+
+	list, err := a.clientset.AppsV1().ReplicaSets(a.config.Resource.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to list replicasets: %w", err)
+	}
+
+	// A deployment owns a replicaset per rollout, the current one has the highest revision.
+	var replicaset *appsv1.ReplicaSet
+	revision := -1
+	for i := range list.Items {
+		item := &list.Items[i]
+		if !slices.ContainsFunc(item.OwnerReferences, func(ref metav1.OwnerReference) bool {
+			return ref.Kind == res.Kind && ref.Name == res.Name
+		}) {
+			continue
+		}
+		if rev := replicaSetRevision(item); rev > revision {
+			replicaset = item
+			revision = rev
+		}
+	}
+
+	if replicaset == nil {
+		return "", fmt.Errorf("no replicasets owned by %s %s found", res.Kind, res.Name)
+	}
+
+	hash = replicaset.Labels["pod-template-hash"]
+	lg.Info("Got pod template hash", "hash", hash)
+
+	return hash, nil
+}
+
+// replicaSetRevision returns the revision of the deployment's rollout the replicaset belongs to,
+// or 0 if it is not set or invalid.
+func replicaSetRevision(rs *appsv1.ReplicaSet) int {
+	revision, err := strconv.Atoi(rs.Annotations["deployment.kubernetes.io/revision"])
+	if err != nil {
+		return 0
+	}
+	return revision
+}
+
+type (
+	objectForReplicas struct {
+		Replicas int `json:"replicas"`
+	}
+
+	objectForSpec struct {
+		Spec objectForReplicas `json:"spec"`
+	}
+)
+
+func (a *Application) getReplicas(ctx context.Context, res *resource) (replicas int, err error) {
+	lg := log.FromContext(ctx)
+	lg.Infof("Trying to get current number of replicas")
+
+	if a.config.Resource.ScaleMethod == "update" {
+		client, err := a.scaleClient(res)
+		if err != nil {
+			return 0, err
+		}
+		var scale *autoscalingv1.Scale
+		err = a.retryK8s(ctx, func() (err error) {
+			scale, err = client.GetScale(ctx, res.Name, metav1.GetOptions{})
+			return err
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to get resource: %w", a.scaleError(res, err))
+		}
+		replicas = int(scale.Spec.Replicas)
+	} else {
+		data, err := a.getScale(ctx, res)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get resource: %w", a.scaleError(res, err))
+		}
+
+		var obj objectForSpec
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return 0, fmt.Errorf("failed to unmarshal response: %w", err)
+		}
+		replicas = obj.Spec.Replicas
+	}
+
+	lg.Info("Got number of replicas", "count", replicas)
+
+	return replicas, nil
+}
+
+// getScale returns the scale subresource of the resource as JSON.
+func (a *Application) getScale(ctx context.Context, res *resource) (data []byte, err error) {
+	err = a.retryK8s(ctx, func() (err error) {
+		if a.customResources() {
+			obj, err := a.customResource(res.Type).Get(ctx, res.Name, metav1.GetOptions{}, "scale")
+			if err != nil {
+				return err
+			}
+			data, err = obj.MarshalJSON()
+			return err
+		}
+		data, err = a.clientset.AppsV1().RESTClient().
+			Get().
+			Namespace(a.config.Resource.Namespace).
+			Resource(res.Type).
+			Name(res.Name).
+			SubResource("scale").
+			DoRaw(ctx)
+		return err
+	})
+	return data, err
+}
+
+// scaleClient is implemented by the typed clients of the resources having the scale subresource.
+type scaleClient interface {
+	GetScale(ctx context.Context, name string, opts metav1.GetOptions) (*autoscalingv1.Scale, error)
+	UpdateScale(ctx context.Context, name string, scale *autoscalingv1.Scale, opts metav1.UpdateOptions) (*autoscalingv1.Scale, error)
+}
+
+// scaleClient returns the typed client for the scale subresource of the resource.
+// Daemon sets and cron jobs are never scaled, so they don't have one.
+func (a *Application) scaleClient(res *resource) (client scaleClient, err error) {
+	if a.customResources() {
+		return &dynamicScaleClient{client: a.customResource(res.Type)}, nil
+	}
+	apps := a.clientset.AppsV1()
+	switch res.Type {
+	case "deployments":
+		return apps.Deployments(a.config.Resource.Namespace), nil
+	case "statefulsets":
+		return apps.StatefulSets(a.config.Resource.Namespace), nil
+	case "replicasets":
+		return apps.ReplicaSets(a.config.Resource.Namespace), nil
+	default:
+		return nil, fmt.Errorf("%s %w", res.ID, errNoScale)
+	}
+}
+
+var errNoScale = errors.New("doesn't support scale subresource, set RESOURCE_SKIP_SCALE to back up without scaling")
+
+// scaleError explains errors of the scale subresource requests,
+// since the API server responds with a bare 404 for both missing resources and resources without the subresource.
+func (a *Application) scaleError(res *resource, err error) error {
+	switch {
+	case apierrors.IsNotFound(err):
+		return fmt.Errorf("%s doesn't exist in namespace %s or %w: %w", res.ID, a.config.Resource.Namespace, errNoScale, err)
+	case apierrors.IsMethodNotSupported(err):
+		return fmt.Errorf("%s %w: %w", res.ID, errNoScale, err)
+	}
+	return err
+}
+
+func (a *Application) scale(ctx context.Context, res *resource, replicas int) (err error) {
+	lg := log.FromContext(ctx)
+
+	if a.config.DryRun {
+		lg.Infof("Dry run: skipping scaling to %d", replicas)
+		return nil
+	}
+
+	lg.Infof("Trying to scale to %d", replicas)
+
+	switch a.config.Resource.ScaleMethod {
+	case "update":
+		err = a.updateScale(ctx, res, replicas)
+	case "strategic":
+		err = a.patchScale(ctx, res, types.StrategicMergePatchType, replicas)
+	default:
+		err = a.patchScale(ctx, res, types.MergePatchType, replicas)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to scale to %d: %w", replicas, a.scaleError(res, err))
+	}
+
+	lg.Infof("Successfuly scaled to %d", replicas)
+
+	return nil
+}
+
+// updateScale updates the scale subresource through the typed client.
+// The scale is fetched on every attempt, so that conflicts with other updates are retried.
+func (a *Application) updateScale(ctx context.Context, res *resource, replicas int) (err error) {
+	client, err := a.scaleClient(res)
+	if err != nil {
+		return err
+	}
+	return a.retryK8s(ctx, func() (err error) {
+		scale, err := client.GetScale(ctx, res.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		scale.Spec.Replicas = int32(replicas)
+		_, err = client.UpdateScale(ctx, res.Name, scale, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// patchScale patches the scale subresource with a patch of the given type.
+func (a *Application) patchScale(ctx context.Context, res *resource, pt types.PatchType, replicas int) (err error) {
+	spec := objectForSpec{
+		Spec: objectForReplicas{Replicas: replicas},
+	}
+
+	patch, err := json.Marshal(&spec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal patch: %w", err)
+	}
+
+	return a.retryK8s(ctx, func() (err error) {
+		if a.customResources() {
+			_, err = a.customResource(res.Type).Patch(ctx, res.Name, pt, patch, metav1.PatchOptions{}, "scale")
+			return err
+		}
+		_, err = a.clientset.AppsV1().RESTClient().
+			Patch(pt).
+			Namespace(a.config.Resource.Namespace).
+			Resource(res.Type).
+			Name(res.Name).
+			SubResource("scale").
+			Body(patch).
+			DoRaw(ctx)
+		return err
+	})
+}
+
+var errPodsNotTerminated = errors.New("pods did not terminate in time")
+
+// poll calls done every poll interval until it reports true
+// and returns timeoutErr if it doesn't happen within wait timeout.
+func (a *Application) poll(ctx context.Context, timeoutErr error, done func(context.Context) (bool, error)) (err error) {
+	return a.pollTimeout(ctx, time.Duration(a.config.Resource.WaitTimeout), timeoutErr, done)
+}
+
+// pollTimeout is like poll, but with the given timeout.
+func (a *Application) pollTimeout(ctx context.Context, timeout time.Duration, timeoutErr error, done func(context.Context) (bool, error)) (err error) {
+	pollCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(time.Duration(a.config.Resource.PollInterval))
+	defer ticker.Stop()
+
+	for {
+		a.health.progress()
+
+		ok, err := done(pollCtx)
+		if err != nil && pollCtx.Err() == nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-pollCtx.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return timeoutErr
+		}
+	}
+}
+
+func (a *Application) wait(ctx context.Context, res *resource) (err error) {
+	lg := log.FromContext(ctx)
+	lg.Info("Waiting for pods to terminate")
+
+	var (
+		selector string
+		owner    types.UID
+	)
+	switch {
+	case a.customResources():
+		// The pods of custom resources are identified by the selector of the scale subresource.
+		selector, err = a.getSelector(ctx, res)
+		if err != nil {
+			return err
+		}
+	case res.Type == "replicasets":
+		// Pods of a standalone replicaset don't necessarily have pod-template-hash,
+		// so they are identified by their owner.
+		rs, err := a.clientset.AppsV1().ReplicaSets(a.config.Resource.Namespace).Get(ctx, res.Name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get replicaset: %w", err)
+		}
+		rsSelector, err := metav1.LabelSelectorAsSelector(rs.Spec.Selector)
+		if err != nil {
+			return fmt.Errorf("invalid replicaset selector: %w", err)
+		}
+		selector = rsSelector.String()
+		owner = rs.UID
+	default:
+		hash, err := a.getPodTemplateHash(ctx, res)
+		if err != nil {
+			return fmt.Errorf("failed to get pod template hash: %w", err)
+		}
+		selector = fmt.Sprintf("pod-template-hash=%s", hash)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(a.config.Resource.WaitTimeout))
+	defer cancel()
+
+	for {
+		done, err := a.watchPods(waitCtx, selector, owner, a.scaleTarget())
+		if waitCtx.Err() != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errPodsNotTerminated
+		}
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+		lg.Debug("Watch has been closed, restarting it")
+	}
+
+	lg.Info("Pods have terminated")
+
+	return nil
+}
+
+// waitStatefulSet waits for the statefulset to have no pods,
+// since its pods don't have pod-template-hash.
+func (a *Application) waitStatefulSet(ctx context.Context, res *resource) (err error) {
+	lg := log.FromContext(ctx)
+	lg.Info("Waiting for pods to terminate")
+
+	statefulsets := a.clientset.AppsV1().StatefulSets(a.config.Resource.Namespace)
+	target := int32(a.scaleTarget())
+
+	err = a.poll(ctx, errPodsNotTerminated, func(ctx context.Context) (done bool, err error) {
+		sts, err := statefulsets.Get(ctx, res.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, fmt.Errorf("failed to get statefulset: %w", err)
+		}
+		return sts.Status.ObservedGeneration >= sts.Generation &&
+			sts.Status.Replicas <= target &&
+			sts.Status.CurrentReplicas <= target, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	lg.Info("Pods have terminated")
+
+	return nil
+}
+
+// watchPods lists pods matching the selector and watches them until all of them are deleted.
+// If owner is not empty, only pods controlled by it are considered.
+// Returns false if the watch has been closed before that.
+func (a *Application) watchPods(ctx context.Context, selector string, owner types.UID, target int) (done bool, err error) {
+	pods := a.clientset.CoreV1().Pods(a.config.Resource.Namespace)
+
+	owned := func(pod *corev1.Pod) bool {
+		if owner == "" {
+			return true
+		}
+		ref := metav1.GetControllerOf(pod)
+		return ref != nil && ref.UID == owner
+	}
+
+	list, err := pods.List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return false, fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	active := make(map[types.UID]struct{}, len(list.Items))
+	for i := range list.Items {
+		if owned(&list.Items[i]) {
+			active[list.Items[i].UID] = struct{}{}
+		}
+	}
+	if len(active) <= target {
+		return true, nil
+	}
+
+	watcher, err := pods.Watch(ctx, metav1.ListOptions{
+		LabelSelector:   selector,
+		ResourceVersion: list.ResourceVersion,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to watch pods: %w", err)
+	}
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return false, nil
+			}
+			a.health.progress()
+
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				if pod, ok := event.Object.(*corev1.Pod); ok && owned(pod) {
+					active[pod.UID] = struct{}{}
+				}
+			case watch.Deleted:
+				if pod, ok := event.Object.(*corev1.Pod); ok {
+					delete(active, pod.UID)
+				}
+			case watch.Error:
+				// Most likely the resource version is too old, so start over.
+				return false, nil
+			}
+
+			if len(active) <= target {
+				return true, nil
+			}
+		}
+	}
+}
+
+func (a *Application) scaleDown(ctx context.Context) (undo func(context.Context) error, err error) {
+	undos := make([]func(context.Context) error, len(a.resources))
+	undo = func(ctx context.Context) error {
+		return concurrently(len(undos), func(i int) error {
+			if undos[i] == nil {
+				return nil
+			}
+			return undos[i](ctx)
+		})
+	}
+
+	err = concurrently(len(a.resources), func(i int) error {
+		res := &a.resources[i]
+		ctx := log.WithContext(ctx, log.FromContext(ctx).With("resource", res.ID))
+
+		resUndo, err := a.scaleDownResource(ctx, res)
+		if err != nil {
+			return fmt.Errorf("failed to scale down %s: %w", res.ID, err)
+		}
+
+		undos[i] = resUndo
+		return nil
+	})
+	if err != nil {
+		// Don't leave already scaled down resources behind,
+		// even if the context has been cancelled.
+		undoCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Duration(a.config.ScaleUpTimeout))
+		defer cancel()
+
+		if undoErr := undo(undoCtx); undoErr != nil {
+			err = fmt.Errorf("%w: %w", err, undoErr)
+		}
+		return nil, err
+	}
+
+	if a.config.Resource.Wait && !a.config.DryRun {
+		concurrently(len(a.resources), func(i int) error {
+			res := &a.resources[i]
+			if res.Idle {
+				return nil
+			}
+
+			ctx := log.WithContext(ctx, log.FromContext(ctx).With("resource", res.ID))
+
+			if err := a.waitResource(ctx, res); err != nil {
+				a.warn(a.lg, "Failed to wait for pods to terminate", "resource", res.ID, "error", err)
+			}
+			return nil
+		})
+	}
+
+	return undo, nil
+}
+
+// Maximum number of resources scaled or waited for concurrently.
+const scaleConcurrency = 4
+
+// concurrently calls fn for each index in [0, n),
+// at most scaleConcurrency at a time, and joins the returned errors.
+func concurrently(n int, fn func(i int) error) error {
+	errs := make([]error, n)
+
+	var g errgroup.Group
+	g.SetLimit(scaleConcurrency)
+
+	for i := range n {
+		g.Go(func() error {
+			errs[i] = fn(i)
+			return nil
+		})
+	}
+
+	g.Wait()
+
+	return errors.Join(errs...)
+}
+
+// scaleTarget returns the number of replicas to scale down to.
+// Restore always scales to zero, so that nothing writes to the directories being restored.
+func (a *Application) scaleTarget() int {
+	if a.config.Mode == "restore" {
+		return 0
+	}
+	return a.config.Resource.ScaleTarget
+}
+
+func (a *Application) scaleDownResource(ctx context.Context, res *resource) (undo func(context.Context) error, err error) {
+	// Custom resources can have the same kinds, but they are always scaled.
+	switch {
+	case a.customResources():
+	case res.Kind == "DaemonSet":
+		return a.suspendDaemonSet(ctx, res)
+	case res.Kind == "CronJob":
+		return a.suspendCronJob(ctx, res)
+	}
+
+	replicas, err := a.getReplicas(ctx, res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current number of replicas: %w", err)
+	}
+
+	res.Replicas = &replicas
+
+	if replicas == 0 {
+		log.FromContext(ctx).Info("Resource is already scaled down to zero, skipping scale down and scale up")
+		res.Idle = true
+		return nil, nil
+	}
+
+	target := a.scaleTarget()
+	if replicas <= target {
+		return nil, fmt.Errorf("scale target %d is not below the current number of replicas %d", target, replicas)
+	}
+
+	if err := a.respectDisruptionBudgets(ctx, res, replicas); err != nil {
+		return nil, err
+	}
+
+	var resumeHPA func(context.Context) error
+	if a.config.Resource.HandleHPA != "ignore" {
+		resumeHPA, err = a.handleHPA(ctx, res)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := a.scale(ctx, res, target); err != nil {
+		err = fmt.Errorf("failed to scale down: %w", err)
+		if resumeHPA != nil {
+			err = errors.Join(err, resumeHPA(ctx))
+		}
+		return nil, err
+	}
+
+	undo = func(ctx context.Context) error {
+		ctx = log.WithContext(ctx, log.FromContext(ctx).With("resource", res.ID))
+
+		var hpaErr error
+		if resumeHPA != nil {
+			hpaErr = resumeHPA(ctx)
+		}
+
+		err := a.retryScaleUp(ctx, func(ctx context.Context, attempt int) error {
+			if attempt != 0 {
+				current, err := a.getReplicas(ctx, res)
+				if err != nil {
+					return fmt.Errorf("failed to get current number of replicas: %w", err)
+				}
+				if current != target {
+					a.warn(log.FromContext(ctx), "Resource has been scaled up by someone else, skipping", "count", current)
+					return nil
+				}
+			}
+			return a.scale(ctx, res, replicas)
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to scale up %s: %w", res.ID, err)
+		}
+		return errors.Join(hpaErr, err)
+	}
+
+	return undo, nil
+}
+
+func (a *Application) waitResource(ctx context.Context, res *resource) (err error) {
+	if a.customResources() {
+		return a.wait(ctx, res)
+	}
+
+	switch res.Kind {
+	case "DaemonSet":
+		return a.waitDaemonSet(ctx, res)
+	case "CronJob":
+		return a.waitCronJob(ctx, res)
+	case "StatefulSet":
+		return a.waitStatefulSet(ctx, res)
+	default:
+		return a.wait(ctx, res)
+	}
+}
+
+// renderArchiveName returns the name of the archive created at the given time
+// rendered from the name template.
+func (a *Application) renderArchiveName(t time.Time) string {
+	name := placeholderRegexp.ReplaceAllStringFunc(a.config.Backup.NameTemplate, func(s string) string {
+		placeholder, format, _ := strings.Cut(s[1:len(s)-1], ":")
+		switch placeholder {
+		case "resource":
+			return a.resourceNames("+")
+		case "namespace":
+			return a.config.Resource.Namespace
+		case "date":
+			if format == "" {
+				format = time.RFC3339
+			}
+			return t.Format(format)
+		}
+		return s
+	})
+	return name + a.archiveExtension()
+}
+
+// archiveNameRegexp returns the regexp matching names of archives
+// that could have been rendered from the name template.
+func (a *Application) archiveNameRegexp() *regexp.Regexp {
+	tmpl := a.config.Backup.NameTemplate
+
+	var b strings.Builder
+	b.WriteByte('^')
+
+	last := 0
+	for _, match := range placeholderRegexp.FindAllStringSubmatchIndex(tmpl, -1) {
+		b.WriteString(regexp.QuoteMeta(tmpl[last:match[0]]))
+		last = match[1]
+
+		placeholder, _, _ := strings.Cut(tmpl[match[2]:match[3]], ":")
+		switch placeholder {
+		case "resource":
+			b.WriteString(regexp.QuoteMeta(a.resourceNames("+")))
+		case "namespace":
+			b.WriteString(regexp.QuoteMeta(a.config.Resource.Namespace))
+		case "date":
+			_, format, _ := strings.Cut(tmpl[match[2]:match[3]], ":")
+			if format == "" {
+				format = time.RFC3339
+			}
+			b.WriteString(timeLayoutRegexp(format))
+		}
+	}
+	b.WriteString(regexp.QuoteMeta(tmpl[last:]))
+
+	// Archives can be compressed, encrypted and deduplicated or not regardless of the current config.
+	b.WriteString(`\.tar(\.gz|\.zst)?(\.enc)?(\.chunks)?$`)
+
+	return regexp.MustCompile(b.String())
+}
+
+// Patterns of the elements of time layouts, longer ones first,
+// so that e.g. names of other resources prefixed with the name of this one aren't taken for dates.
+var timeLayoutPatterns = []struct {
+	elem    string
+	pattern string
+}{
+	{"January", `[A-Za-z]+`},
+	{"Jan", `[A-Za-z]+`},
+	{"Monday", `[A-Za-z]+`},
+	{"Mon", `[A-Za-z]+`},
+	{"MST", `[A-Za-z]+|[+-]\d+`},
+	{"Z070000", `Z|[+-]\d{6}`},
+	{"Z07:00:00", `Z|[+-]\d{2}:\d{2}:\d{2}`},
+	{"Z0700", `Z|[+-]\d{4}`},
+	{"Z07:00", `Z|[+-]\d{2}:\d{2}`},
+	{"Z07", `Z|[+-]\d{2}`},
+	{"-070000", `[+-]\d{6}`},
+	{"-07:00:00", `[+-]\d{2}:\d{2}:\d{2}`},
+	{"-0700", `[+-]\d{4}`},
+	{"-07:00", `[+-]\d{2}:\d{2}`},
+	{"-07", `[+-]\d{2}`},
+	{"_2006", `_\d{4}`},
+	{"2006", `\d{4}`},
+	{"__2", `[ \d]{2}\d`},
+	{"_2", `[ \d]\d`},
+	{"002", `\d{3}`},
+	{"15", `\d{2}`},
+	{"01", `\d{2}`},
+	{"02", `\d{2}`},
+	{"03", `\d{2}`},
+	{"04", `\d{2}`},
+	{"05", `\d{2}`},
+	{"06", `\d{2}`},
+	{"1", `\d{1,2}`},
+	{"2", `\d{1,2}`},
+	{"3", `\d{1,2}`},
+	{"4", `\d{1,2}`},
+	{"5", `\d{1,2}`},
+	{"PM", `[AP]M`},
+	{"pm", `[ap]m`},
+}
+
+// timeLayoutRegexp returns the regexp matching times formatted with the Go time layout.
+func timeLayoutRegexp(layout string) string {
+	var b strings.Builder
+	b.WriteString("(?:")
+
+outer:
+	for i := 0; i < len(layout); {
+		// Fractional seconds, which are optional with nines.
+		if c := layout[i]; (c == '.' || c == ',') && i+1 < len(layout) && (layout[i+1] == '0' || layout[i+1] == '9') {
+			j := i + 1
+			for j < len(layout) && layout[j] == layout[i+1] {
+				j++
+			}
+			if j == len(layout) || layout[j] < '0' || layout[j] > '9' {
+				if layout[i+1] == '0' {
+					fmt.Fprintf(&b, `[.,]\d{%d}`, j-i-1)
+				} else {
+					fmt.Fprintf(&b, `(?:[.,]\d{1,%d})?`, j-i-1)
+				}
+				i = j
+				continue
+			}
+		}
+
+		for _, p := range timeLayoutPatterns {
+			if strings.HasPrefix(layout[i:], p.elem) {
+				b.WriteString("(?:" + p.pattern + ")")
+				i += len(p.elem)
+				continue outer
+			}
+		}
+
+		b.WriteString(regexp.QuoteMeta(layout[i : i+1]))
+		i++
+	}
+
+	b.WriteByte(')')
+	return b.String()
+}
+
+// isArchiveName reports whether name looks like a name of an archive created by this tool.
+func (a *Application) isArchiveName(name string) bool {
+	return a.archiveRegexp.MatchString(name)
+}
+
+func (a *Application) archiveExtension() string {
+	ext := ".tar"
+	if a.config.Backup.Compress {
+		ext += ".gz"
+	}
+	if a.config.Backup.EncryptionKey != "" {
+		ext += ".enc"
+	}
+	if a.config.Backup.Mode == "dedup" {
+		ext += chunksExtension
+	}
+	return ext
+}
+
+func (a *Application) archiveContentType() string {
+	if a.config.Backup.Mode == "dedup" {
+		return "application/json"
+	}
+	if a.config.Backup.EncryptionKey != "" {
+		return "application/octet-stream"
+	}
+	if !a.config.Backup.Compress {
+		return "application/x-tar"
+	}
+	return "application/gzip"
+}
+
+func (a *Application) archive(ctx context.Context) (err error) {
+	now := time.Now().In(a.location)
+	name := a.renderArchiveName(now)
+	for _, dst := range a.destinations {
+		dst.archiveKey = a.objectKey(dst.config, name, now)
+	}
+
+	lg := log.FromContext(ctx).With("name", name)
+
+	if a.index != nil {
+		a.extendChain(name)
+	}
+
+	if a.config.DryRun {
+		lg.Info("Dry run: estimating archive size")
+
+		counter := new(countingWriter)
+		if err := a.writeArchive(ctx, counter); err != nil {
+			return err
+		}
+
+		a.archiveName = name
+		a.archiveSize = counter.n
+
+		lg.Info("Estimated archive size", "size", byteCountIEC(a.archiveSize))
+
+		return nil
+	}
+
+	lg.Info("Creating archive")
+
+	file, err := os.Create(filepath.Join(a.config.Backup.TempDirectory(), name))
+	if err != nil {
+		return fmt.Errorf("failed to create archive file: %w", err)
+	}
+	// Don't leave a partial archive behind, e.g. when the backup times out.
+	defer errdefer.Close(&err, func() error {
+		file.Close()
+		return os.Remove(file.Name())
+	})
+
+	hash := sha256.New()
+	if err := a.writeArchive(ctx, io.MultiWriter(file, hash)); err != nil {
+		return err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get archive info: %w", err)
+	}
+
+	a.archiveName = name
+	a.archiveFile = file
+	a.archiveSize = fileInfo.Size()
+	a.archiveChecksum = hex.EncodeToString(hash.Sum(nil))
+
+	lg.Info("Created archive", "size", byteCountIEC(a.archiveSize))
+
+	return nil
+}
+
+// verifyArchive reads the archive file through and checks
+// that it has as many entries as have been written.
+func (a *Application) verifyArchive(ctx context.Context) (err error) {
+	lg := log.FromContext(ctx)
+	lg.Info("Trying to verify archive")
+
+	tr, r, err := a.openArchive()
+	if err != nil {
+		return err
+	}
+
+	entries := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		a.health.progress()
+
+		_, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		entries++
+	}
+
+	// Read the rest, so that the gzip checksum and the last encrypted chunk are verified.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	if entries != a.archiveEntries {
+		return fmt.Errorf("archive has %d entries instead of %d", entries, a.archiveEntries)
+	}
+
+	lg.Info("Successfuly verified archive", "entries", entries)
+
+	return nil
+}
+
+func (a *Application) writeArchive(ctx context.Context, w io.Writer) (err error) {
+	lg := log.FromContext(ctx)
+
+	out := new(countingWriter)
+	w = io.MultiWriter(w, a.health, out)
+	if a.config.Backup.MaxSize != 0 {
+		w = &limitedWriter{w: w, max: int64(a.config.Backup.MaxSize)}
+	}
+
+	stats := &archiveStats{
+		lg:      lg,
+		verbose: a.config.Backup.Verbose,
+		lastLog: time.Now(),
+	}
+
+	var encWriter *encryptWriter
+	if a.config.Backup.EncryptionKey != "" {
+		encWriter, err = newEncryptWriter(w, a.config.Backup.EncryptionKey)
+		if err != nil {
+			return fmt.Errorf("failed to create encrypt writer: %w", err)
+		}
+		w = encWriter
+	}
+
+	// Deduplicated archives are compressed chunk by chunk on upload.
+	var gzipWriter io.WriteCloser
+	if a.config.Backup.Compress && a.config.Backup.Mode != "dedup" {
+		gzipWriter, err = a.newGzipWriter(w)
+		if err != nil {
+			return fmt.Errorf("failed to create gzip writer: %w", err)
+		}
+		w = gzipWriter
+	}
+
+	// Only the tar headers and data of the entries of the directories are hashed,
+	// so that the manifest, stream entries, compression and encryption
+	// don't make archives of the same content differ.
+	// The headers include the modification times of the directories as well.
+	var content *pausableWriter
+	contentHash := sha256.New()
+	if a.config.Backup.WarnUnchanged {
+		content = &pausableWriter{w: contentHash, paused: true}
+		w = io.MultiWriter(w, content)
+	}
+
+	tarWriter := tar.NewWriter(w)
+
+	if a.manifest != nil {
+		if err := writeManifest(tarWriter, a.manifest); err != nil {
+			return fmt.Errorf("failed to archive manifest: %w", err)
+		}
+		stats.entries++
+	}
+
+	// Prefix entries with the directory's base name only when there are several of them,
+	// so that single directory archives keep their layout.
+	prefixed := len(a.config.Backup.Directories) > 1
+	// Padding of the previous entry is written along with the next header.
+	if content != nil {
+		if err := tarWriter.Flush(); err != nil {
+			return fmt.Errorf("failed to flush archive: %w", err)
+		}
+		content.paused = false
+	}
+	for _, dir := range a.config.Backup.Directories {
+		var prefix string
+		if prefixed {
+			prefix = filepath.Base(dir)
+		}
+		if err := a.addDir(ctx, tarWriter, w, stats, dir, prefix); err != nil {
+			return fmt.Errorf("failed to archive directory %s: %w", dir, err)
+		}
+	}
+	if content != nil {
+		if err := tarWriter.Flush(); err != nil {
+			return fmt.Errorf("failed to flush archive: %w", err)
+		}
+		content.paused = true
+		a.contentChecksum = hex.EncodeToString(contentHash.Sum(nil))
+	}
+
+	if err := a.writeStreamEntries(ctx, tarWriter, stats); err != nil {
+		return err
+	}
+
+	// Written after the directories, since it contains the number of files.
+	if a.config.Backup.IncludeInfo {
+		if err := a.writeInfo(tarWriter, stats); err != nil {
+			return fmt.Errorf("failed to archive backup info: %w", err)
+		}
+		stats.entries++
+	}
+
+	if a.prevIndex != nil {
+		if err := a.writeDeleted(tarWriter); err != nil {
+			return fmt.Errorf("failed to archive list of deleted files: %w", err)
+		}
+		stats.entries++
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return fmt.Errorf("failed to close tar writer: %w", err)
+	}
+
+	if gzipWriter != nil {
+		if err := gzipWriter.Close(); err != nil {
+			return fmt.Errorf("failed to close gzip writer: %w", err)
+		}
+	}
+
+	if encWriter != nil {
+		if err := encWriter.Close(); err != nil {
+			return fmt.Errorf("failed to close encrypt writer: %w", err)
+		}
+	}
+
+	ratio := 1.0
+	if out.n != 0 {
+		ratio = float64(stats.size) / float64(out.n)
+	}
+
+	a.archiveEntries = stats.entries
+
+	lg = lg.With(
+		"files", stats.files,
+		"size", byteCountIEC(stats.size),
+		"archive_size", byteCountIEC(out.n),
+		"ratio", fmt.Sprintf("%.2f", ratio),
+	)
+	if a.prevIndex != nil {
+		lg = lg.With("unchanged", stats.unchanged)
+	}
+	lg.Info("Archived files")
+
+	return nil
+}
+
+// newGzipWriter returns the gzip writer, which compresses blocks in parallel
+// if BACKUP_PARALLEL_COMPRESSION is set. The output is a regular gzip stream either way.
+func (a *Application) newGzipWriter(w io.Writer) (gw io.WriteCloser, err error) {
+	level := int(a.config.Backup.CompressionLevel)
+	if !a.config.Backup.ParallelCompression {
+		return gzip.NewWriterLevel(w, level)
+	}
+
+	pw, err := pgzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+
+	workers := a.config.Backup.CompressionWorkers
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if err := pw.SetConcurrency(int(a.config.Backup.CompressionBlockSize), workers); err != nil {
+		return nil, err
+	}
+
+	return pw, nil
+}
+
+// Minimal interval between archiving progress log lines.
+const archiveProgressInterval = 5 * time.Second
+
+// archiveStats counts entries added to the archive, as well as regular files and their total size,
+// logging the progress periodically if verbose.
+type archiveStats struct {
+	lg        *log.Logger
+	verbose   bool
+	entries   int
+	files     int
+	unchanged int // files skipped by the incremental backup
+	size      int64
+	lastLog   time.Time
+}
+
+// add counts the regular file.
+func (s *archiveStats) add(size int64) {
+	s.entries++
+	s.files++
+	s.size += size
+
+	if s.verbose && time.Since(s.lastLog) >= archiveProgressInterval {
+		s.lastLog = time.Now()
+		s.lg.Info("Archiving", "files", s.files, "size", byteCountIEC(s.size))
+	}
+}
+
+var errArchiveTooLarge = errors.New("archive exceeds maximum size")
+
+// limitedWriter fails once more than max bytes would have been written,
+// so that a runaway archive is never uploaded.
+type limitedWriter struct {
+	w   io.Writer
+	n   int64
+	max int64
+}
+
+func (w *limitedWriter) Write(b []byte) (n int, err error) {
+	if w.n+int64(len(b)) > w.max {
+		return 0, fmt.Errorf("%w of %s", errArchiveTooLarge, byteCountIEC(w.max))
+	}
+	n, err = w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// pausableWriter writes to w unless it's paused.
+type pausableWriter struct {
+	w      io.Writer
+	paused bool
+}
+
+func (w *pausableWriter) Write(b []byte) (n int, err error) {
+	if w.paused {
+		return len(b), nil
+	}
+	return w.w.Write(b)
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (n int, err error) {
+	w.n += int64(len(b))
+	return len(b), nil
+}
+
+// matchPattern reports whether name, which is relative to the backup directory, matches pattern.
+// Patterns without a slash are matched against the base name,
+// so that e.g. *.tmp matches files in every subdirectory,
+// while the ones with a slash, including a leading one, are matched against the whole name.
+// A ** segment matches any number of directories.
+func matchPattern(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(name)
+	}
+	pattern = strings.TrimPrefix(pattern, "/")
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) != 0 {
+		if pattern[0] == "**" {
+			for i := range len(name) + 1 {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], name[0]); !matched {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func matchAnyPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// addDir adds the directory to the archive.
+// w is the writer underlying tw, sparse files are written directly to it.
+// The walk is aborted once the context is done.
+func (a *Application) addDir(ctx context.Context, tw *tar.Writer, w io.Writer, stats *archiveStats, dir, prefix string) (err error) {
+	// Directories that are being walked, used to detect symlink loops.
+	var parents []fs.FileInfo
+	isLoop := func(info fs.FileInfo) bool {
+		return slices.ContainsFunc(parents, func(parent fs.FileInfo) bool {
+			return os.SameFile(parent, info)
+		})
+	}
+
+	var walk func(name string) error
+	walk = func(name string) error {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("archiving aborted: %w", err)
+		}
+
+		fullName := filepath.Join(dir, filepath.FromSlash(name))
+
+		if name != "." && matchAnyPattern(a.config.Backup.Exclude, name) {
+			return nil
+		}
+
+		// The backup directory itself is always followed.
+		stat := os.Lstat
+		if name == "." {
+			stat = os.Stat
+		}
+
+		info, err := stat(fullName)
+		if err != nil {
+			return err
+		}
+
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			link, err = os.Readlink(fullName)
+			if err != nil {
+				return err
+			}
+			// Symlinks are stored as they are, unless they should be followed.
+			// Dangling symlinks and the ones that would cause a loop are stored anyway.
+			if a.config.Backup.FollowSymlinks {
+				target, err := os.Stat(fullName)
+				if err == nil && !isLoop(target) {
+					info, link = target, ""
+				}
+			}
+		}
+
+		switch mode := info.Mode(); {
+		case mode.IsDir(), mode&fs.ModeSymlink != 0:
+		case mode.IsRegular():
+			// Include patterns apply only to files, directories are always walked.
+			if len(a.config.Backup.Include) != 0 && !matchAnyPattern(a.config.Backup.Include, name) {
+				return nil
+			}
+		default:
+			return fmt.Errorf("%s: cannot add non-regular file", fullName)
+		}
+
+		if name != "." || prefix != "" {
+			// The header gets mode bits and modification time from the file info,
+			// as well as ownership from the underlying syscall.Stat_t.
+			header, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			header.Name = path.Join(prefix, name)
+			if info.IsDir() {
+				header.Name += "/"
+			}
+			unchanged := a.index != nil && a.track(header.Name, info)
+			if info.Mode().IsRegular() {
+				if unchanged {
+					stats.unchanged++
+					return nil
+				}
+				return a.addFile(ctx, tw, w, stats, header, fullName)
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			stats.entries++
+		}
+
+		switch {
+		case info.IsDir():
+			entries, err := os.ReadDir(fullName)
+			if err != nil {
+				return err
+			}
+			parents = append(parents, info)
+			for _, entry := range entries {
+				if err := walk(path.Join(name, entry.Name())); err != nil {
+					return err
+				}
+			}
+			parents = parents[:len(parents)-1]
+		}
+
+		return nil
+	}
+
+	return walk(".")
+}
+
+// addFile adds the regular file to the archive.
+// If BACKUP_SPARSE is set and the file has holes, only its data is stored.
+func (a *Application) addFile(ctx context.Context, tw *tar.Writer, w io.Writer, stats *archiveStats, header *tar.Header, name string) (err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if a.config.Backup.Sparse {
+		extents, err := fileExtents(file, header.Size)
+		if err != nil {
+			return fmt.Errorf("%s: failed to detect holes: %w", name, err)
+		}
+		if isSparse(extents, header.Size) {
+			if err := writeSparseFile(ctx, tw, w, header, file, extents); err != nil {
+				return err
+			}
+			stats.add(header.Size)
+			return nil
+		}
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	// Large files are copied for a long time, so the context is checked while copying too.
+	n, err := io.Copy(tw, &contextReader{ctx: ctx, r: file})
+	if err != nil {
+		return err
+	}
+	stats.add(n)
+
+	return nil
+}
+
+// uploadProgress logs the upload progress at most once per interval
+// and when the upload is complete.
+type uploadProgress struct {
+	lg       *log.Logger
+	health   *health
+	interval time.Duration
+	mu       sync.Mutex // parts can be uploaded concurrently
+	current  int64
+	total    int64
+	lastLog  time.Time
+	finished bool
+}
+
+func (p *uploadProgress) Read(b []byte) (n int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.current += int64(len(b))
+	p.health.progress()
+
+	if p.current >= p.total {
+		if p.finished {
+			return len(b), nil
+		}
+		p.finished = true
+	} else if time.Since(p.lastLog) < p.interval {
+		return len(b), nil
+	}
+	p.lastLog = time.Now()
+
+	// Avoid NaN for empty archives.
+	percent := 100.0
+	if p.total != 0 {
+		percent = float64(p.current) / float64(p.total) * 100.0
+	}
+
+	p.lg.Infof("Uploaded %s / %s (%.2f%%)",
+		byteCountIEC(p.current),
+		byteCountIEC(p.total),
+		percent)
+	return len(b), nil
 }
 
-func NewApplication() (app *Application, err error) {
-	app = new(Application)
+// throttledReader limits the rate at which the underlying reader is read.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
 
-	if err := env.Parse(&app.config); err != nil {
-		return nil, fmt.Errorf("failed to parse environment variables: %w", err)
+func (t *throttledReader) Read(b []byte) (n int, err error) {
+	// WaitN fails if more than burst bytes are requested at once.
+	if burst := t.limiter.Burst(); len(b) > burst {
+		b = b[:burst]
 	}
 
-	if err := app.config.Validate(); err != nil {
-		return nil, fmt.Errorf("invalid config: %w", err)
+	n, err = t.r.Read(b)
+	if n > 0 {
+		if err := t.limiter.WaitN(t.ctx, n); err != nil {
+			return n, err
+		}
 	}
 
-	restConfig, err := rest.InClusterConfig()
-	if err != nil {
-		return nil, fmt.Errorf("failed to obtain k8s config: %w", err)
+	return n, err
+}
+
+// throttle limits the rate at which r is read to the max bandwidth of the destination, if it is set.
+// Parts are uploaded sequentially in this case.
+func (d *destination) throttle(ctx context.Context, r io.Reader) io.Reader {
+	if d.config.MaxBandwidth == 0 {
+		return r
 	}
 
-	app.clientset, err = kubernetes.NewForConfig(restConfig)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create kubernetes clientset: %w", err)
+	log.FromContext(ctx).Info("Throttling upload", "max_bandwidth", byteCountIEC(int64(d.config.MaxBandwidth))+"/s")
+
+	// Allow bursts of a second worth of data.
+	limit := int(d.config.MaxBandwidth)
+	return &throttledReader{
+		ctx:     ctx,
+		r:       r,
+		limiter: rate.NewLimiter(rate.Limit(limit), limit),
 	}
+}
 
-	if app.config.Telegram.BotToken != "" {
-		app.tgBot, err = tgbotapi.NewBotAPI(app.config.Telegram.BotToken)
+// throughput returns the average number of bytes transferred per second.
+func throughput(size int64, d time.Duration) int64 {
+	if d <= 0 {
+		return size
+	}
+	return int64(float64(size) / d.Seconds())
+}
+
+func (a *Application) upload(ctx context.Context, dst *destination) (err error) {
+	lg := log.FromContext(ctx)
+
+	if a.config.DryRun {
+		lg.Info("Dry run: skipping upload to S3")
+		return nil
+	}
+
+	parts, partSize := 1, a.archiveSize
+	if a.archiveSize > int64(dst.config.PartSize) {
+		parts, partSize, _, err = minio.OptimalPartInfo(a.archiveSize, uint64(dst.config.PartSize))
 		if err != nil {
-			return nil, fmt.Errorf("failed to create Telegram Bot API: %w", err)
+			return fmt.Errorf("failed to compute part size: %w", err)
 		}
 	}
 
-	app.s3Client, err = minio.New(app.config.S3.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(app.config.S3.AccessKeyID, app.config.S3.SecretAccessKey, ""),
-		Secure: !app.config.S3.Unsecure,
-		Region: app.config.S3.Region,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	lg.Info("Uploading archive to S3",
+		"parts", parts,
+		"part_size", byteCountIEC(partSize),
+		"storage_class", dst.storageClass(),
+	)
+
+	opts := a.putObjectOptions(dst)
+	opts.Progress = &uploadProgress{
+		lg:       log.With("key", dst.archiveKey),
+		health:   a.health,
+		interval: time.Duration(dst.config.ProgressInterval),
+		current:  0,
+		total:    a.archiveSize,
 	}
 
-	resourceParts := strings.SplitN(app.config.Resource.ID, "/", 2)
-	app.resourceName = resourceParts[1]
-	switch resourceParts[0] {
-	case "deployment", "deployments":
-		app.resourceType = "deployments"
-		app.resourceKind = "Deployment"
-	case "statefulset", "statefulsets":
-		app.resourceType = "statefulsets"
-		app.resourceKind = "StatefulSet"
-	case "replicaset", "replicasets":
-		app.resourceType = "replicasets"
-		app.resourceKind = "ReplicaSet"
+	start := time.Now()
+
+	if a.config.Backup.Mode == "dedup" {
+		if err := a.uploadChunks(ctx, dst); err != nil {
+			return fmt.Errorf("failed to upload archive to S3: %w", err)
+		}
+	} else if err := a.storeArchive(ctx, &s3Store{dst: dst, opts: opts}, dst.archiveKey); err != nil {
+		return fmt.Errorf("failed to upload archive to S3: %w", err)
 	}
 
-	app.logData = new(bytes.Buffer)
-	app.lg = log.NewWithOptions(io.MultiWriter(os.Stdout, app.logData), log.Options{
-		ReportTimestamp: true,
-		Formatter:       log.TextFormatter,
-	})
+	lg.Info("Uploaded archive to S3", "throughput", byteCountIEC(throughput(a.archiveSize, time.Since(start)))+"/s")
 
-	return app, nil
+	return a.finishUpload(ctx, dst)
 }
 
-func (a *Application) Run() (err error) {
-	defer func() {
-		a.notify(err == nil)
-	}()
+// stream creates the archive and uploads it to S3 at the same time,
+// so that it is never stored on disk.
+func (a *Application) stream(ctx context.Context) (err error) {
+	now := time.Now().In(a.location)
+	name := a.renderArchiveName(now)
+	// Mirrors aren't supported, so there is only the primary destination.
+	dst := a.destinations[0]
+	key := a.objectKey(dst.config, name, now)
 
-	lg := a.lg.With(
-		"resource", a.config.Resource.ID,
-		"namespace", a.config.Resource.Namespace,
-	)
+	lg := log.FromContext(ctx).With("name", name, "key", key)
+	lg.Info("Streaming archive to S3", "storage_class", dst.storageClass())
 
-	ctx := log.WithContext(context.Background(), lg)
-	ctx, cancel := context.WithTimeout(ctx, 3*time.Minute)
-	defer cancel()
+	a.archiveName = name
+	dst.archiveKey = key
+
+	pr, pw := io.Pipe()
+	hash := sha256.New()
+	counter := new(countingWriter)
+
+	done := make(chan error, 1)
+	go func() {
+		err := a.writeArchive(ctx, io.MultiWriter(pw, hash, counter))
+		// Makes the upload fail if archiving has failed.
+		pw.CloseWithError(err)
+		done <- err
+	}()
 
-	scaleUp, err := a.scaleDown(ctx)
+	// Size is unknown, so the archive is uploaded in parts.
+	_, err = dst.client.PutObject(ctx, dst.config.Bucket, key, dst.throttle(ctx, pr), -1, a.putObjectOptions(dst))
+	// Unblocks archiving if the upload has failed.
+	pr.CloseWithError(err)
+
+	if archiveErr := <-done; archiveErr != nil {
+		return fmt.Errorf("failed to archive: %w", archiveErr)
+	}
 	if err != nil {
-		lg.Error("Failed to scale down", "error", err)
-		return fmt.Errorf("failed to scale down: %w", err)
+		return fmt.Errorf("failed to upload archive to S3: %w", err)
 	}
-	defer func() {
-		lg := a.lg.With(
-			"resource", a.config.Resource.ID,
-			"namespace", a.config.Resource.Namespace,
-		)
 
-		ctx := log.WithContext(context.Background(), lg)
-		ctx, cancel := context.WithTimeout(ctx, time.Minute)
-		defer cancel()
-
-		scaleErr := scaleUp(ctx)
-		if scaleErr == nil {
-			return
-		}
+	a.archiveSize = counter.n
+	a.archiveChecksum = hex.EncodeToString(hash.Sum(nil))
 
-		lg.Error("Failed to scale up", "error", scaleErr)
+	lg.Info("Streamed archive to S3", "size", byteCountIEC(a.archiveSize))
 
-		scaleErr = fmt.Errorf("failed to scale up: %w", err)
-		if err != nil {
-			err = fmt.Errorf("%w: %w", err, scaleErr)
-		} else {
-			err = scaleErr
-		}
-	}()
+	return a.finishUpload(ctx, dst)
+}
 
-	lg = a.lg.With("directory", a.config.Backup.Directory)
-	ctx = log.WithContext(context.Background(), lg)
+func (a *Application) putObjectOptions(dst *destination) minio.PutObjectOptions {
+	var expires time.Time
+	if dst.config.ArchiveLifetime != 0 {
+		expires = time.Now().Add(time.Duration(dst.config.ArchiveLifetime))
+	}
 
-	if err := a.archive(ctx); err != nil {
-		lg.Error("Failed to archive", "error", err)
-		return fmt.Errorf("failed to archive: %w", err)
+	contentType := dst.config.ContentType
+	if contentType == "" {
+		contentType = a.archiveContentType()
 	}
-	defer func() {
-		a.archiveFile.Close()
-		if err := os.Remove(a.archiveFile.Name()); err != nil {
-			a.lg.Warn("Failed to delete temporary archive file", "error", err)
-		}
-	}()
 
-	lg = a.lg.With(
-		"endpoint", a.config.S3.Endpoint,
-		"bucket", a.config.S3.Bucket,
-		"name", a.archiveName,
-		"file", a.archiveFile.Name(),
-	)
-	ctx = log.WithContext(context.Background(), lg)
+	metadata := a.archiveMetadata()
+	for key, value := range dst.config.Metadata {
+		metadata[key] = value
+	}
 
-	if err := a.upload(ctx); err != nil {
-		a.lg.Error("Failed to upload to S3", "error", err)
-		return fmt.Errorf("failed to upload to S3: %w", err)
+	var retainUntil time.Time
+	if dst.config.LockMode != "" {
+		retainUntil = time.Now().AddDate(0, 0, dst.config.LockDays)
 	}
 
-	return nil
+	return minio.PutObjectOptions{
+		StorageClass:         dst.config.StorageClass,
+		ContentType:          contentType,
+		Expires:              expires,
+		ServerSideEncryption: dst.encryption,
+		UserMetadata:         metadata,
+		PartSize:             uint64(dst.config.PartSize),
+		NumThreads:           uint(dst.config.NumThreads),
+		Mode:                 minio.RetentionMode(dst.config.LockMode),
+		RetainUntilDate:      retainUntil,
+	}
 }
 
-func (a *Application) getPodTemplateHash(ctx context.Context) (hash string, err error) {
-	lg := log.FromContext(ctx)
-	lg.Info("Trying to get pod template hash")
-
-	appsV1 := a.clientset.AppsV1()
-	replicasets := appsV1.ReplicaSets(a.config.Resource.Namespace)
+// finishUpload verifies the uploaded archive, uploads its checksum
+// and presigns its download URL if needed.
+func (a *Application) finishUpload(ctx context.Context, dst *destination) (err error) {
+	if err := a.verifyUpload(ctx, dst); err != nil {
+		return err
+	}
 
-	var replicaset *appsv1.ReplicaSet
-	if a.resourceName != "replicasets" {
-		list, err := replicasets.List(ctx, metav1.ListOptions{})
-		if err != nil {
-			return "", fmt.Errorf("failed to list replicasets: %w", err)
+	if dst.config.Checksum {
+		if err := a.uploadChecksum(ctx, dst); err != nil {
+			return err
 		}
-		for i := range list.Items {
-			item := &list.Items[i]
-			for _, ref := range item.OwnerReferences {
-				if ref.Kind == a.resourceKind && ref.Name == a.resourceName {
-					replicaset = item
-					break
-				}
-			}
+	}
+
+	// The chunk list is useless without the chunks, so there is nothing to download.
+	if dst.config.PresignExpiry != 0 && a.config.Backup.Mode != "dedup" {
+		// Not every provider supports presigning, which is not a reason to fail the backup.
+		if err := a.presign(ctx, dst); err != nil {
+			a.warn(log.FromContext(ctx), "Failed to presign download URL", "error", err)
 		}
-	} else {
-		replicaset, err = replicasets.Get(ctx, a.resourceName, metav1.GetOptions{})
-		if err != nil {
-			return "", fmt.Errorf("failed to get replicaset: %w", err)
+	}
+
+	if dst.config.LatestKey != "" {
+		if err := a.copyLatest(ctx, dst); err != nil {
+			a.warn(log.FromContext(ctx), "Failed to copy archive to latest key", "error", err)
 		}
 	}
-	if replicaset == nil {
-		return "", errors.New("could not find replicaset")
+
+	if a.index != nil {
+		// The next backup is based on the previous index then, which is still consistent.
+		if err := a.uploadIndex(ctx, dst); err != nil {
+			a.warn(log.FromContext(ctx), "Failed to upload backup index", "error", err)
+		}
 	}
 
-	hash = replicaset.Labels["pod-template-hash"]
-	lg.Info("Got pod template hash", "hash", hash)
+	// The history is compared with the primary destination only.
+	if a.checksums != nil && dst == a.destinations[0] {
+		if err := a.uploadChecksums(ctx, dst); err != nil {
+			a.warn(log.FromContext(ctx), "Failed to upload checksum history", "error", err)
+		}
+	}
 
-	return hash, nil
+	return nil
 }
 
-type (
-	objectForReplicas struct {
-		Replicas int `json:"replicas"`
+// copyLatest copies the archive along with its metadata and checksum file to the latest key,
+// so that the newest archive can be downloaded without listing.
+func (a *Application) copyLatest(ctx context.Context, dst *destination) (err error) {
+	key := strings.NewReplacer(
+		"{namespace}", a.config.Resource.Namespace,
+		"{resource}", a.resourceNames("+"),
+	).Replace(strings.TrimLeft(dst.config.LatestKey, "/"))
+
+	lg := log.FromContext(ctx)
+	lg.Info("Copying archive to latest key", "latest", key)
+
+	copyObject := func(src, dstKey string) error {
+		// Composing handles objects larger than 5GiB, which can't be copied at once.
+		_, err := dst.client.ComposeObject(ctx,
+			minio.CopyDestOptions{
+				Bucket:     dst.config.Bucket,
+				Object:     dstKey,
+				Encryption: dst.encryption,
+			},
+			minio.CopySrcOptions{
+				Bucket:     dst.config.Bucket,
+				Object:     src,
+				Encryption: dst.encryption,
+			},
+		)
+		return err
 	}
 
-	objectForSpec struct {
-		Spec objectForReplicas `json:"spec"`
+	if err := copyObject(dst.archiveKey, key); err != nil {
+		return fmt.Errorf("failed to copy archive: %w", err)
+	}
+	if dst.config.Checksum {
+		if err := copyObject(dst.archiveKey+".sha256", key+".sha256"); err != nil {
+			return fmt.Errorf("failed to copy archive checksum: %w", err)
+		}
 	}
-)
 
-func (a *Application) getReplicas(ctx context.Context) (replicas int, err error) {
-	lg := log.FromContext(ctx)
-	lg.Infof("Trying to get current number of replicas")
+	lg.Info("Copied archive to latest key", "latest", key)
+
+	return nil
+}
 
-	data, err := a.clientset.AppsV1().RESTClient().
-		Get().
-		Namespace(a.config.Resource.Namespace).
-		Resource(a.resourceType).
-		Name(a.resourceName).
-		SubResource("scale").
-		DoRaw(ctx)
+// presign generates a time-limited download URL of the archive for notifications.
+func (a *Application) presign(ctx context.Context, dst *destination) (err error) {
+	expiry := time.Duration(dst.config.PresignExpiry)
+
+	u, err := dst.client.PresignedGetObject(ctx, dst.config.Bucket, dst.archiveKey, expiry, nil)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get resource: %w", err)
+		return err
 	}
 
-	var obj objectForSpec
-	if err := json.Unmarshal(data, &obj); err != nil {
-		return 0, fmt.Errorf("failed to unmarshal response: %w", err)
+	dst.downloadURL = u.String()
+	log.FromContext(ctx).Info("Presigned download URL", "expiry", humanizeDuration(expiry))
+
+	return nil
+}
+
+// User metadata key of the archive's SHA-256 checksum.
+// It is canonicalized the same way as the HTTP headers that carry user metadata.
+const checksumMetadataKey = "Sha256"
+
+// User metadata key of the checksum of the backed up content, see writeArchive.
+const contentChecksumMetadataKey = "Content-Sha256"
+
+// User metadata keys set by archiveMetadata, which S3_METADATA must not override.
+var reservedMetadataKeys = []string{
+	checksumMetadataKey,
+	contentChecksumMetadataKey,
+	"Namespace",
+	"Cluster",
+	"Resource-Kind",
+	"Resource-Name",
+	"Resource-Replicas",
+	modeMetadataKey,
+	parentMetadataKey,
+}
+
+// archiveMetadata returns user metadata of the archive,
+// which makes it possible to tell where it came from.
+// Resource kinds, names and replicas are comma-separated in the same order,
+// replicas are empty for resources that weren't scaled.
+func (a *Application) archiveMetadata() map[string]string {
+	kinds := make([]string, len(a.resources))
+	names := make([]string, len(a.resources))
+	replicas := make([]string, len(a.resources))
+	for i := range a.resources {
+		res := &a.resources[i]
+		kinds[i] = res.Kind
+		names[i] = res.Name
+		if res.Replicas != nil {
+			replicas[i] = strconv.Itoa(*res.Replicas)
+		}
 	}
 
-	replicas = obj.Spec.Replicas
-	lg.Info("Got number of replicas", "count", replicas)
+	metadata := map[string]string{
+		"Namespace":         a.config.Resource.Namespace,
+		"Resource-Kind":     strings.Join(kinds, ","),
+		"Resource-Name":     strings.Join(names, ","),
+		"Resource-Replicas": strings.Join(replicas, ","),
+	}
+	// The checksum is unknown before streaming.
+	if a.archiveChecksum != "" {
+		metadata[checksumMetadataKey] = a.archiveChecksum
+	}
+	if a.contentChecksum != "" {
+		metadata[contentChecksumMetadataKey] = a.contentChecksum
+	}
+	if a.config.ClusterName != "" {
+		metadata["Cluster"] = a.config.ClusterName
+	}
+	if a.config.Backup.Mode == "dedup" {
+		metadata[modeMetadataKey] = "dedup"
+	}
+	if a.index != nil {
+		// Restore follows the parents down to the full archive.
+		if a.prevIndex != nil {
+			metadata[modeMetadataKey] = "incremental"
+			metadata[parentMetadataKey] = a.prevIndex.Chain[len(a.prevIndex.Chain)-1]
+		} else {
+			metadata[modeMetadataKey] = "full"
+		}
+	}
 
-	return replicas, nil
+	return metadata
 }
 
-func (a *Application) scale(ctx context.Context, replicas int) (err error) {
+// verifyUpload checks that the uploaded archive has the expected size and checksum.
+func (a *Application) verifyUpload(ctx context.Context, dst *destination) (err error) {
 	lg := log.FromContext(ctx)
-	lg.Infof("Trying to scale to %d", replicas)
+	lg.Info("Trying to verify uploaded archive")
 
-	spec := objectForSpec{
-		Spec: objectForReplicas{Replicas: replicas},
+	info, err := dst.client.StatObject(ctx, dst.config.Bucket, dst.archiveKey, minio.StatObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to stat uploaded archive: %w", err)
 	}
 
-	patch, err := json.Marshal(&spec)
-	if err != nil {
-		return fmt.Errorf("failed to marshal patch: %w", err)
+	// Only the chunk list is stored in place of deduplicated archives.
+	if a.config.Backup.Mode != "dedup" && info.Size != a.archiveSize {
+		return fmt.Errorf("uploaded archive size mismatch: expected %d, got %d", a.archiveSize, info.Size)
 	}
 
-	_, err = a.clientset.AppsV1().RESTClient().
-		Patch(types.MergePatchType).
-		Namespace(a.config.Resource.Namespace).
-		Resource(a.resourceType).
-		Name(a.resourceName).
-		SubResource("scale").
-		Body(patch).
-		DoRaw(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to scale to %d: %w", replicas, err)
+	// Streamed archives don't have the checksum in their metadata.
+	if checksum := info.UserMetadata[checksumMetadataKey]; !a.config.Backup.Stream && checksum != a.archiveChecksum {
+		return fmt.Errorf("uploaded archive checksum mismatch: expected %s, got %s", a.archiveChecksum, checksum)
 	}
 
-	lg.Infof("Successfuly scaled to %d", replicas)
+	lg.Info("Successfuly verified uploaded archive")
 
 	return nil
 }
 
-func (a *Application) wait(ctx context.Context) (err error) {
+func (a *Application) uploadChecksum(ctx context.Context, dst *destination) (err error) {
+	key := dst.archiveKey + ".sha256"
+
 	lg := log.FromContext(ctx)
-	lg.Info("Waiting for pods to terminate")
+	lg.Info("Uploading archive checksum to S3", "checksum", key)
 
-	hash, err := a.getPodTemplateHash(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to get pod template hash: %w", err)
-	}
-	selector := fmt.Sprintf("pod-template-hash=%s", hash)
+	// Same format as sha256sum uses, so that the file can be checked with sha256sum -c.
+	data := fmt.Sprintf("%s  %s\n", a.archiveChecksum, a.archiveName)
 
-	for {
-		list, err := a.clientset.CoreV1().
-			Pods(a.config.Resource.Namespace).
-			List(ctx, metav1.ListOptions{LabelSelector: selector})
-		if err != nil {
-			return fmt.Errorf("failed to list pods: %w", err)
-		}
+	var expires time.Time
+	if dst.config.ArchiveLifetime != 0 {
+		expires = time.Now().Add(time.Duration(dst.config.ArchiveLifetime))
+	}
 
-		if len(list.Items) == 0 {
-			break
-		}
-		time.Sleep(5 * time.Second)
+	if _, err := dst.client.PutObject(ctx,
+		dst.config.Bucket,
+		key,
+		strings.NewReader(data),
+		int64(len(data)),
+		minio.PutObjectOptions{
+			StorageClass:         dst.config.StorageClass,
+			ContentType:          "text/plain",
+			Expires:              expires,
+			ServerSideEncryption: dst.encryption,
+		},
+	); err != nil {
+		return fmt.Errorf("failed to upload archive checksum to S3: %w", err)
 	}
 
-	lg.Info("Pods have terminated")
+	lg.Info("Uploaded archive checksum to S3", "checksum", key)
 
 	return nil
 }
 
-func (a *Application) scaleDown(ctx context.Context) (undo func(context.Context) error, err error) {
-	replicas, err := a.getReplicas(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get current number of replicas: %w", err)
+// resourceNames returns names of all the resources joined with sep.
+func (a *Application) resourceNames(sep string) string {
+	names := make([]string, len(a.resources))
+	for i := range a.resources {
+		names[i] = a.resources[i].Name
 	}
+	return strings.Join(names, sep)
+}
 
-	if err := a.scale(ctx, 0); err != nil {
-		return nil, fmt.Errorf("failed to scale down: %w", err)
+// objectKey returns the key of the object with the given name
+// under the key prefix of the config rendered for the given time.
+func (a *Application) objectKey(config *S3Config, name string, t time.Time) string {
+	prefix := strings.NewReplacer(
+		"{namespace}", a.config.Resource.Namespace,
+		"{resource}", a.resourceNames("+"),
+		"{year}", t.Format("2006"),
+		"{month}", t.Format("01"),
+		"{day}", t.Format("02"),
+	).Replace(config.KeyPrefix)
+
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return name
 	}
 
-	if a.config.Resource.Wait {
-		if err := a.wait(ctx); err != nil {
-			a.lg.Warn("Failed to wait for pods to terminate", "error", err)
+	return prefix + "/" + name
+}
+
+// pruneKeyPrefix returns the part of the key prefix
+// which is shared by all the archives regardless of their date.
+func (a *Application) pruneKeyPrefix(config *S3Config) string {
+	prefix := config.KeyPrefix
+	for _, placeholder := range []string{"{year}", "{month}", "{day}"} {
+		if idx := strings.Index(prefix, placeholder); idx != -1 {
+			prefix = prefix[:idx]
 		}
 	}
 
-	undo = func(ctx context.Context) error {
-		if err := a.scale(ctx, replicas); err != nil {
-			return fmt.Errorf("failed to scale up: %w", err)
+	prefix = strings.NewReplacer(
+		"{namespace}", a.config.Resource.Namespace,
+		"{resource}", a.resourceNames("+"),
+	).Replace(prefix)
+
+	return strings.TrimLeft(prefix, "/")
+}
+
+// listArchives returns archives of the resources sorted from newest to oldest.
+func (a *Application) listArchives(ctx context.Context, dst *destination) (archives []minio.ObjectInfo, err error) {
+	for obj := range dst.client.ListObjects(ctx, dst.config.Bucket, minio.ListObjectsOptions{
+		Prefix:    a.pruneKeyPrefix(dst.config),
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("failed to list archives: %w", obj.Err)
+		}
+		if a.isArchiveName(path.Base(obj.Key)) {
+			archives = append(archives, obj)
 		}
-		return nil
 	}
 
-	return undo, nil
+	slices.SortFunc(archives, func(x, y minio.ObjectInfo) int {
+		return y.LastModified.Compare(x.LastModified)
+	})
+
+	return archives, nil
 }
 
-func (a *Application) archive(ctx context.Context) (err error) {
-	name := fmt.Sprintf("backup-%s.tar.gz", time.Now().Format(time.RFC3339))
+// checksumHistory lists the content checksums of the latest archives, newest first.
+// It is stored in the primary bucket next to the archives, so that the comparison
+// doesn't depend on the previous archives, which might have been pruned.
+type checksumHistory struct {
+	Archives []checksumEntry `json:"archives"`
+}
 
-	lg := log.FromContext(ctx).With("name", name)
-	lg.Info("Creating archive")
+type checksumEntry struct {
+	Name     string    `json:"name"`
+	Checksum string    `json:"checksum"`
+	Time     time.Time `json:"time"`
+}
 
-	file, err := os.Create(filepath.Join(os.TempDir(), name))
-	if err != nil {
-		return fmt.Errorf("failed to create archive file: %w", err)
-	}
-	defer errdefer.Close(&err, file.Close)
+// checksumsKey returns the key of the checksum history.
+func (a *Application) checksumsKey(config *S3Config) string {
+	return a.stateKey(config, "checksums.json")
+}
 
-	gzipWriter := gzip.NewWriter(file)
-	tarWriter := tar.NewWriter(gzipWriter)
+// checkUnchanged warns if the content of the archive is the same as of one of the previous ones,
+// which might mean that e.g. the volume is no longer mounted or nothing writes to it anymore.
+// The history is kept only if it has been loaded, so that a failure doesn't wipe it.
+func (a *Application) checkUnchanged(ctx context.Context, dst *destination) (err error) {
+	key := a.checksumsKey(dst.config)
 
-	if err := tarWriter.AddFS(os.DirFS(a.config.Backup.Directory)); err != nil {
-		return fmt.Errorf("failed to archive directory: %w", err)
-	}
+	lg := log.FromContext(ctx).With("checksums", key)
+	lg.Info("Trying to compare archive with the previous ones")
 
-	if err := tarWriter.Close(); err != nil {
-		return fmt.Errorf("failed to close tar writer: %w", err)
+	obj, err := dst.client.GetObject(ctx, dst.config.Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get checksum history: %w", err)
 	}
+	defer obj.Close()
 
-	if err := gzipWriter.Close(); err != nil {
-		return fmt.Errorf("failed to close gzip writer: %w", err)
+	var history checksumHistory
+	if err := json.NewDecoder(bufio.NewReader(obj)).Decode(&history); err != nil {
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			return fmt.Errorf("failed to read checksum history: %w", err)
+		}
+		lg.Info("No checksum history found")
 	}
+	a.checksums = &history
 
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return fmt.Errorf("failed to get archive info: %w", err)
+	i := slices.IndexFunc(history.Archives, func(entry checksumEntry) bool {
+		return entry.Checksum == a.contentChecksum
+	})
+	switch {
+	case len(history.Archives) == 0:
+		lg.Info("No previous archive to compare with")
+	case i == 0:
+		a.warn(lg, "Backup content unchanged since last run", "previous", history.Archives[0].Name)
+	case i > 0:
+		a.warn(lg, "Backup content is the same as of an earlier run",
+			"archive", history.Archives[i].Name,
+			"runs_ago", i+1,
+		)
+	default:
+		lg.Info("Backup content has changed since last run", "previous", history.Archives[0].Name)
 	}
 
-	a.archiveName = name
-	a.archiveFile = file
-	a.archiveSize = fileInfo.Size()
-
-	lg.Info("Created archive", "size", byteCountIEC(a.archiveSize))
-
 	return nil
 }
 
-type uploadProgress struct {
-	lg      *log.Logger
-	current int64
-	total   int64
+// add adds the content checksum of the archive to the history,
+// keeping at most the given number of the latest ones.
+func (h *checksumHistory) add(entry checksumEntry, keep int) {
+	h.Archives = slices.Insert(h.Archives, 0, entry)
+	if len(h.Archives) > keep {
+		h.Archives = h.Archives[:keep]
+	}
 }
 
-func (p *uploadProgress) Read(b []byte) (n int, err error) {
-	p.current += int64(len(b))
-	p.lg.Infof("Uploaded %s / %s (%.2f)",
-		byteCountIEC(p.current),
-		byteCountIEC(p.total),
-		float64(p.current)/float64(p.total)*100.0)
-	return len(b), nil
-}
+// uploadChecksums adds the content checksum of the uploaded archive to the history and uploads it.
+func (a *Application) uploadChecksums(ctx context.Context, dst *destination) (err error) {
+	key := a.checksumsKey(dst.config)
 
-func (a *Application) upload(ctx context.Context) (err error) {
 	lg := log.FromContext(ctx)
-	lg.Info("Uploading archive to S3")
+	lg.Info("Uploading checksum history to S3", "checksums", key)
 
-	var expires time.Time
-	if a.config.S3.ArchiveLifetime != 0 {
-		expires = time.Now().Add(time.Duration(a.config.S3.ArchiveLifetime))
+	a.checksums.add(checksumEntry{
+		Name:     a.archiveName,
+		Checksum: a.contentChecksum,
+		Time:     a.startTime,
+	}, a.config.Backup.UnchangedHistory)
+
+	data, err := json.Marshal(a.checksums)
+	if err != nil {
+		return fmt.Errorf("failed to marshal checksum history: %w", err)
 	}
 
-	if _, err := a.s3Client.PutObject(ctx,
-		a.config.S3.Bucket,
-		a.archiveName,
-		a.archiveFile,
-		a.archiveSize,
+	if _, err := dst.client.PutObject(ctx,
+		dst.config.Bucket,
+		key,
+		bytes.NewReader(data),
+		int64(len(data)),
 		minio.PutObjectOptions{
-			Progress: &uploadProgress{
-				lg:      log.With("name", a.archiveName),
-				current: 0,
-				total:   a.archiveSize,
-			},
-			StorageClass: a.config.S3.StorageClass,
-			ContentType:  "application/gzip",
-			Expires:      expires,
+			StorageClass:         dst.config.StorageClass,
+			ContentType:          "application/json",
+			ServerSideEncryption: dst.encryption,
 		},
 	); err != nil {
-		return fmt.Errorf("failed to upload archive to S3: %w", err)
+		return fmt.Errorf("failed to upload checksum history to S3: %w", err)
 	}
 
-	lg.Info("Uploaded archive to S3")
+	lg.Info("Uploaded checksum history to S3", "checksums", key, "archives", len(a.checksums.Archives))
 
 	return nil
 }
 
-func (a *Application) notify(success bool) {
-	if a.tgBot == nil {
-		return
-	}
+func (a *Application) prune(ctx context.Context, dst *destination) (err error) {
+	lg := log.FromContext(ctx)
+	lg.Info("Pruning old archives")
 
-	log.Info("Sending Telegram notification")
+	archives, err := a.listArchives(ctx, dst)
+	if err != nil {
+		return err
+	}
 
-	var b strings.Builder
-	if success {
-		fmt.Fprintf(&b, "<tg-emoji emoji-id=\"5431815452437257407\">🐳</tg-emoji> Backup of %s has <b>succeeded</b>\n", a.resourceName)
-	} else {
-		fmt.Fprintf(&b, "<tg-emoji emoji-id=\"5370869711888194012\">👾</tg-emoji> Backup of %s has <b>failed</b>\n", a.resourceName)
+	var deadline time.Time
+	if dst.config.RetentionDays != 0 {
+		deadline = time.Now().AddDate(0, 0, -dst.config.RetentionDays)
 	}
 
-	if a.archiveFile != nil {
-		sz := byteCountIEC(a.archiveSize)
-		fmt.Fprintf(&b, "Tarball size: %s\n", sz)
+	kept := 0
+	for _, obj := range archives {
+		// Archives the current incremental backup is based on are needed to restore it.
+		if obj.Key == dst.archiveKey || a.inChain(path.Base(obj.Key)) {
+			kept++
+			continue
+		}
+
+		expired := !deadline.IsZero() && obj.LastModified.Before(deadline)
+		exceeded := dst.config.RetentionCount != 0 && kept >= dst.config.RetentionCount
+		if !expired && !exceeded {
+			kept++
+			continue
+		}
+
+		if a.config.DryRun {
+			lg.Info("Dry run: skipping deletion of old archive", "name", obj.Key)
+			continue
+		}
+
+		if err := dst.client.RemoveObject(ctx, dst.config.Bucket, obj.Key, minio.RemoveObjectOptions{}); err != nil {
+			return fmt.Errorf("failed to delete archive %s: %w", obj.Key, err)
+		}
+		if dst.config.Checksum {
+			if err := dst.client.RemoveObject(ctx, dst.config.Bucket, obj.Key+".sha256", minio.RemoveObjectOptions{}); err != nil {
+				return fmt.Errorf("failed to delete archive checksum %s: %w", obj.Key, err)
+			}
+		}
+
+		lg.Info("Deleted old archive", "name", obj.Key, "last_modified", obj.LastModified)
 	}
 
-	b.WriteString("\nLog output was:\n<pre>")
-	io.Copy(&b, a.logData)
-	b.WriteString("</pre>")
+	lg.Info("Pruned old archives", "kept", kept)
 
-	if _, err := a.tgBot.Send(tgbotapi.MessageConfig{
-		BaseChat: tgbotapi.BaseChat{
-			ChatID:           a.config.Telegram.ChatID,
-			ReplyToMessageID: 0,
-		},
-		Text:      b.String(),
-		ParseMode: "HTML",
-	}); err != nil {
-		log.Error("Failed to send Telegram notification", "error", err)
+	if a.config.Backup.Mode == "dedup" {
+		if err := a.pruneChunks(ctx, dst); err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
 func byteCountIEC(b int64) string {
@@ -473,15 +3105,65 @@ func byteCountIEC(b int64) string {
 		float64(b)/float64(div), "KMGTPE"[exp])
 }
 
+func humanizeDuration(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
+
 func main() {
+	// Checked before loading the config, so that it can be invalid or missing.
+	if os.Getenv("MODE") == "version" || slices.Contains(os.Args[1:], "--version") {
+		fmt.Println(versionString())
+		return
+	}
+
 	app, err := NewApplication()
 	if err != nil {
-		log.Error("Failed to setup application", "error", err)
+		reportSetupFailure(err)
 		os.Exit(1)
 	}
 
-	if err := app.Run(); err != nil {
+	// Cancel the backup on SIGTERM/SIGINT instead of exiting immediately,
+	// so that the workload still gets scaled back up.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		app.lg.Warn("Received signal, cancelling backup", "signal", sig)
+		// Let the next signal terminate the process.
+		signal.Stop(signals)
+		cancel()
+	}()
+
+	if app.config.Health.Addr != "" {
+		app.serveHealth()
+	}
+
+	run := app.Run
+	if app.config.Mode == "restore" {
+		run = app.Restore
+	}
+
+	if err := run(ctx); err != nil {
 		log.Error("Failed to run application", "error", err)
 		os.Exit(1)
 	}
+
+	// Otherwise nothing but the log would tell about the outcome of the run.
+	if code := app.config.Telegram.FailureExitCode; code != 0 && app.tgFailed {
+		log.Error("Finished, but failed to send Telegram notification", "exit_code", code)
+		os.Exit(code)
+	}
+
+	// Lets the scheduler tell runs with warnings apart from clean ones.
+	if code := app.config.WarningExitCode; code != 0 && app.result(nil).Status() == statusWarning {
+		log.Warn("Finished with warnings", "exit_code", code)
+		os.Exit(code)
+	}
 }
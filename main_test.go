@@ -0,0 +1,618 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/infastin/gorack/xtypes"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// fakeScale serves the scale subresource of deployments of the fake clientset,
+// which the object tracker doesn't support.
+type fakeScale struct {
+	mu       sync.Mutex
+	replicas map[string]int32
+}
+
+func newFakeScale(cs *fake.Clientset, replicas map[string]int32) *fakeScale {
+	s := &fakeScale{replicas: replicas}
+
+	cs.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		name := action.(k8stesting.GetAction).GetName()
+		return true, &autoscalingv1.Scale{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: action.GetNamespace()},
+			Spec:       autoscalingv1.ScaleSpec{Replicas: s.get(name)},
+			Status:     autoscalingv1.ScaleStatus{Selector: "app=" + name},
+		}, nil
+	})
+
+	cs.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		scale := action.(k8stesting.UpdateAction).GetObject().(*autoscalingv1.Scale)
+		s.mu.Lock()
+		s.replicas[scale.Name] = scale.Spec.Replicas
+		s.mu.Unlock()
+		return true, scale, nil
+	})
+
+	return s
+}
+
+func (s *fakeScale) get(name string) int32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.replicas[name]
+}
+
+// newTestRun returns the application backing up deployment/db with 3 replicas
+// from a directory into the local destination.
+func newTestRun(t *testing.T) (a *Application, scale *fakeScale) {
+	t.Helper()
+
+	cs := fake.NewClientset()
+	scale = newFakeScale(cs, map[string]int32{"db": 3})
+
+	dataDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dataDir, "data"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	a = &Application{
+		clientset: cs,
+		resources: []resource{parseResource("deployment/db")},
+		fsDest:    &fsDestination{dir: t.TempDir()},
+		health:    newHealth(time.Minute),
+		metrics:   &metrics{resource: "deployment/db", namespace: "default"},
+		location:  time.UTC,
+	}
+	a.config.Resource = ResourceConfig{
+		IDs:          []string{"deployment/db"},
+		Namespace:    "default",
+		WaitTimeout:  xtypes.Duration(time.Second),
+		PollInterval: xtypes.Duration(time.Second),
+		ScaleMethod:  "update",
+		HandleHPA:    "ignore",
+	}
+	a.config.Backup = BackupConfig{
+		Directories:  []string{dataDir},
+		Timeout:      xtypes.Duration(time.Minute),
+		NameTemplate: "{resource}-{date}",
+		Mode:         "full",
+		TempDir:      t.TempDir(),
+	}
+	a.config.ScaleUpTimeout = xtypes.Duration(time.Minute)
+	a.config.DestType = "fs"
+	a.archiveRegexp = a.archiveNameRegexp()
+	a.setupLogger()
+	a.logData = new(bytes.Buffer)
+
+	return a, scale
+}
+
+func TestRunScalesUpWhenCancelledDuringArchiving(t *testing.T) {
+	a, scale := newTestRun(t)
+
+	// The stream entry signals that archiving has started and keeps it going until cancelled.
+	started := filepath.Join(t.TempDir(), "started")
+	a.config.Backup.StreamEntries = map[string]string{"slow": "touch " + started + " && exec sleep 60"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		for {
+			if _, err := os.Stat(started); err == nil {
+				if replicas := scale.get("db"); replicas != 0 {
+					t.Errorf("archiving with %d replicas", replicas)
+				}
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	if err := a.Run(ctx); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if replicas := scale.get("db"); replicas != 3 {
+		t.Fatalf("got %d replicas after cancellation, want 3", replicas)
+	}
+}
+
+func TestRunScalesUpWhenCancelledDuringPostScaleDelay(t *testing.T) {
+	a, scale := newTestRun(t)
+	a.config.Backup.PostScaleDelay = xtypes.Duration(time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	phase := func() string {
+		a.health.mu.Lock()
+		defer a.health.mu.Unlock()
+		return a.health.phase
+	}
+
+	go func() {
+		for phase() != "post_scale_delay" {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if replicas := scale.get("db"); replicas != 0 {
+			t.Errorf("waiting with %d replicas", replicas)
+		}
+		cancel()
+	}()
+
+	err := a.Run(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want cancellation", err)
+	}
+
+	if replicas := scale.get("db"); replicas != 3 {
+		t.Fatalf("got %d replicas after cancellation, want 3", replicas)
+	}
+}
+
+func TestWaitFetchesReplicaSetByName(t *testing.T) {
+	cs := fake.NewClientset(&appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default", UID: "uid"},
+		Spec: appsv1.ReplicaSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+		},
+	})
+
+	a := &Application{
+		clientset: cs,
+		health:    newHealth(time.Minute),
+	}
+	a.config.Resource.Namespace = "default"
+	a.config.Resource.WaitTimeout = xtypes.Duration(time.Minute)
+
+	res := parseResource("replicaset/db")
+	if err := a.wait(context.Background(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	var fetched bool
+	for _, action := range cs.Actions() {
+		if action.GetResource().Resource != "replicasets" {
+			continue
+		}
+		switch action := action.(type) {
+		case k8stesting.GetAction:
+			fetched = fetched || action.GetName() == "db"
+		case k8stesting.ListAction:
+			t.Errorf("listed replicasets")
+		}
+	}
+	if !fetched {
+		t.Error("replicaset was not fetched by name")
+	}
+}
+
+func TestChecksumHistoryAdd(t *testing.T) {
+	entry := func(name string) checksumEntry {
+		return checksumEntry{Name: name, Checksum: name + "-sum"}
+	}
+	names := func(h *checksumHistory) (names []string) {
+		for _, entry := range h.Archives {
+			names = append(names, entry.Name)
+		}
+		return names
+	}
+
+	tests := []struct {
+		name string
+		prev []string
+		keep int
+		want []string
+	}{
+		{name: "empty", keep: 3, want: []string{"new"}},
+		{name: "below limit", prev: []string{"b", "a"}, keep: 3, want: []string{"new", "b", "a"}},
+		{name: "at limit", prev: []string{"c", "b", "a"}, keep: 3, want: []string{"new", "c", "b"}},
+		{name: "only last", prev: []string{"b", "a"}, keep: 1, want: []string{"new"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h checksumHistory
+			for _, name := range tt.prev {
+				h.Archives = append(h.Archives, entry(name))
+			}
+
+			h.add(entry("new"), tt.keep)
+
+			if got := names(&h); !slices.Equal(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeS3 is an in-memory S3 bucket serving just enough of the API for the tests.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+// newFakeS3 returns the destination uploading to a fake S3 bucket.
+func newFakeS3(t *testing.T) (dst *destination, s3 *fakeS3) {
+	t.Helper()
+
+	s3 = &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(s3)
+	t.Cleanup(srv.Close)
+
+	client, err := minio.New(strings.TrimPrefix(srv.URL, "http://"), &minio.Options{
+		Creds:        credentials.NewStaticV4("", "", ""),
+		Region:       "us-east-1",
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &destination{
+		config: &S3Config{Bucket: "backups"},
+		client: client,
+	}, s3
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/backups/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/backups/":
+		type object struct {
+			Key          string
+			Size         int
+			LastModified string
+		}
+		var result struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Name     string
+			Prefix   string
+			Contents []object
+		}
+		result.Name = "backups"
+		result.Prefix = r.URL.Query().Get("prefix")
+		for key, data := range s.objects {
+			if strings.HasPrefix(key, result.Prefix) {
+				result.Contents = append(result.Contents, object{
+					Key:          key,
+					Size:         len(data),
+					LastModified: time.Now().UTC().Format(time.RFC3339),
+				})
+			}
+		}
+		slices.SortFunc(result.Contents, func(x, y object) int { return strings.Compare(x.Key, y.Key) })
+		xml.NewEncoder(w).Encode(&result)
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.objects[key] = data
+		w.Header().Set("ETag", `"etag"`)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := s.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprintf(w, `<Error><Code>NoSuchKey</Code><Key>%s</Key></Error>`, key)
+			}
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (s *fakeS3) object(key string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.objects[key]
+}
+
+// keys returns the keys of the stored objects having the prefix.
+func (s *fakeS3) keys(prefix string) (keys []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestArchiveNameRegexp(t *testing.T) {
+	newApp := func(tmpl, id string) *Application {
+		a := &Application{resources: []resource{parseResource(id)}}
+		a.config.Resource.Namespace = "default"
+		a.config.Backup.NameTemplate = tmpl
+		return a
+	}
+
+	templates := []string{
+		"backup-{date}",
+		"{resource}-{date}",
+		"{resource}-{date:2006-01-02T15-04-05}",
+		"{namespace}.{resource}.{date:Jan _2 2006 15.04.05.000 MST}",
+		"{date:20060102}-{resource}",
+		"{resource}",
+	}
+	extensions := []struct {
+		name string
+		set  func(c *BackupConfig)
+	}{
+		{name: "plain", set: func(c *BackupConfig) {}},
+		{name: "compressed", set: func(c *BackupConfig) { c.Compress = true }},
+		{name: "encrypted", set: func(c *BackupConfig) { c.EncryptionKey = "secret" }},
+		{name: "compressed and encrypted", set: func(c *BackupConfig) { c.Compress, c.EncryptionKey = true, "secret" }},
+		{name: "deduplicated", set: func(c *BackupConfig) { c.Mode = "dedup" }},
+		{name: "compressed and deduplicated", set: func(c *BackupConfig) { c.Compress, c.Mode = true, "dedup" }},
+	}
+	times := []time.Time{
+		time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		time.Date(2026, 12, 31, 23, 59, 59, 999_000_000, time.FixedZone("EET", 2*60*60)),
+	}
+
+	for _, tmpl := range templates {
+		t.Run(tmpl, func(t *testing.T) {
+			// A resource whose name starts with the name of the other one.
+			a := newApp(tmpl, "deployment/db")
+			other := newApp(tmpl, "statefulset/db-replica")
+			re := a.archiveNameRegexp()
+
+			for _, ext := range extensions {
+				ext.set(&a.config.Backup)
+				ext.set(&other.config.Backup)
+
+				for _, now := range times {
+					if name := a.renderArchiveName(now); !re.MatchString(name) {
+						t.Errorf("%s: %s doesn't match %s", ext.name, name, re)
+					}
+					if !strings.Contains(tmpl, "{resource}") {
+						continue
+					}
+					if name := other.renderArchiveName(now); re.MatchString(name) {
+						t.Errorf("%s: archive %s of the other resource matches %s", ext.name, name, re)
+					}
+				}
+
+				a.config.Backup = BackupConfig{NameTemplate: tmpl}
+				other.config.Backup = BackupConfig{NameTemplate: tmpl}
+			}
+
+			for _, name := range []string{"dump.sql", a.renderArchiveName(times[0]) + ".sha256"} {
+				if re.MatchString(name) {
+					t.Errorf("%s matches %s", name, re)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryK8s(t *testing.T) {
+	backoff := k8sBackoff
+	k8sBackoff = time.Millisecond
+	t.Cleanup(func() { k8sBackoff = backoff })
+
+	gr := schema.GroupResource{Group: "apps", Resource: "deployments"}
+	conflict := apierrors.NewConflict(gr, "db", errors.New("object has been modified"))
+
+	tests := []struct {
+		name      string
+		err       error
+		failures  int  // number of requests failing with err
+		cancel    bool // cancel the context on the first request
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "conflict", err: conflict, failures: 2, wantCalls: 3},
+		{name: "internal error", err: apierrors.NewInternalError(errors.New("etcd leader changed")), failures: 2, wantCalls: 3},
+		{name: "service unavailable", err: apierrors.NewServiceUnavailable("unavailable"), failures: 1, wantCalls: 2},
+		{name: "too many requests", err: apierrors.NewTooManyRequests("slow down", 1), failures: 1, wantCalls: 2},
+		{name: "retries exhausted", err: conflict, failures: 10, wantCalls: 4, wantErr: true},
+		{name: "not found", err: apierrors.NewNotFound(gr, "db"), failures: 10, wantCalls: 1, wantErr: true},
+		{name: "forbidden", err: apierrors.NewForbidden(gr, "db", errors.New("denied")), failures: 10, wantCalls: 1, wantErr: true},
+		{name: "cancelled", err: conflict, failures: 10, cancel: true, wantCalls: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			cs := fake.NewClientset(&appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+			})
+
+			calls := 0
+			cs.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				calls++
+				if tt.cancel {
+					cancel()
+				}
+				if calls <= tt.failures {
+					return true, nil, tt.err
+				}
+				return false, nil, nil
+			})
+
+			a := &Application{clientset: cs}
+			a.config.K8sMaxRetries = 3
+
+			err := a.retryK8s(ctx, func() error {
+				_, err := cs.AppsV1().Deployments("default").Get(ctx, "db", metav1.GetOptions{})
+				return err
+			})
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("got %d calls, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		// Patterns without a slash match base names at any depth.
+		{pattern: "*.tmp", name: "a.tmp", want: true},
+		{pattern: "*.tmp", name: "dir/sub/a.tmp", want: true},
+		{pattern: "*.tmp", name: "a.tmp.bak", want: false},
+		{pattern: "cache", name: "dir/cache", want: true},
+		// A leading slash anchors them to the backup directory.
+		{pattern: "/cache", name: "cache", want: true},
+		{pattern: "/cache", name: "dir/cache", want: false},
+		// Patterns with a slash match whole names.
+		{pattern: "cache/*", name: "cache/a", want: true},
+		{pattern: "cache/*", name: "dir/cache/a", want: false},
+		{pattern: "cache/*", name: "cache/a/b", want: false},
+		{pattern: "cache/*", name: "cache", want: false},
+		{pattern: "dir/*.log", name: "dir/a.log", want: true},
+		// ** matches any number of directories.
+		{pattern: "**/*.log", name: "a.log", want: true},
+		{pattern: "**/*.log", name: "dir/sub/a.log", want: true},
+		{pattern: "logs/**/*.gz", name: "logs/a.gz", want: true},
+		{pattern: "logs/**/*.gz", name: "logs/2026/01/a.gz", want: true},
+		{pattern: "logs/**/*.gz", name: "other/logs/a.gz", want: false},
+		{pattern: "logs/**", name: "logs/a/b", want: true},
+		{pattern: "logs/**", name: "logs", want: true},
+		{pattern: "logs/**", name: "logs2/a", want: false},
+		{pattern: "**", name: "dir/a", want: true},
+		// * doesn't cross directories.
+		{pattern: "*/a", name: "dir/sub/a", want: false},
+		{pattern: "[ab].txt", name: "dir/b.txt", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.name, func(t *testing.T) {
+			if got := matchPattern(tt.pattern, tt.name); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArchiveExcludeInclude(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for _, name := range []string{"data.db", "data.tmp", "cache/a.db", "cache/sub/b.db", "sub/cache", "sub/c.db", "sub/c.txt"} {
+		writeTestFile(t, filepath.Join(dir, filepath.FromSlash(name)), name, now)
+	}
+
+	a := &Application{health: newHealth(time.Minute)}
+	a.config.Backup.Directories = []string{dir}
+	// Excluding a directory excludes everything in it.
+	a.config.Backup.Exclude = []string{"*.tmp", "/cache"}
+	a.config.Backup.Include = []string{"**/*.db", "sub/cache"}
+
+	var b bytes.Buffer
+	if err := a.writeArchive(context.Background(), &b); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"data.db", "sub/", "sub/c.db", "sub/cache"}
+	if got := slices.Sorted(maps.Keys(readTestArchive(t, &b))); !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	const rate = 1 << 20 // 1 MiB/s
+
+	dst := &destination{config: &S3Config{MaxBandwidth: rate}}
+
+	t.Run("rate", func(t *testing.T) {
+		// The first second worth of data is read at once.
+		data := make([]byte, rate*3/2)
+
+		start := time.Now()
+		n, err := io.Copy(io.Discard, dst.throttle(context.Background(), bytes.NewReader(data)))
+		elapsed := time.Since(start)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(data)) {
+			t.Fatalf("read %d bytes, want %d", n, len(data))
+		}
+		if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+			t.Fatalf("read in %s, want about 500ms", elapsed)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		data := make([]byte, rate*10)
+
+		start := time.Now()
+		_, err := io.Copy(io.Discard, dst.throttle(ctx, bytes.NewReader(data)))
+		elapsed := time.Since(start)
+
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want cancellation", err)
+		}
+		if elapsed > time.Second {
+			t.Fatalf("cancelled after %s", elapsed)
+		}
+	})
+}
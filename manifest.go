@@ -0,0 +1,269 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/charmbracelet/log"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+// Name of the archive entry containing the manifests.
+const manifestName = "manifest.yaml"
+
+// PAX record marking the manifest entry,
+// so that restore can tell it apart from a file with the same name.
+const manifestPAXRecord = "K8SBACKUP.manifest"
+
+// manifestObject is a Kubernetes object which can be serialized into the manifest.
+type manifestObject interface {
+	runtime.Object
+	metav1.Object
+}
+
+// fetchManifest fetches the resources, and optionally ConfigMaps and Secrets
+// referenced by their pod templates, and serializes them into a multi-document YAML.
+// It must be called before scaling down, so that the manifest has the original spec.
+func (a *Application) fetchManifest(ctx context.Context) (err error) {
+	lg := log.FromContext(ctx)
+	lg.Info("Trying to fetch manifest")
+
+	var (
+		b          bytes.Buffer
+		configMaps []string
+		secrets    []string
+	)
+
+	for i := range a.resources {
+		res := &a.resources[i]
+
+		obj, template, err := a.getObject(ctx, res)
+		if err != nil {
+			return fmt.Errorf("failed to get %s: %w", res.ID, err)
+		}
+
+		if err := writeManifestObject(&b, obj, a.resourceGroupVersion(res).WithKind(res.Kind)); err != nil {
+			return err
+		}
+
+		if a.config.Backup.IncludeConfigs {
+			podConfigMaps, podSecrets := podReferences(&template.Spec)
+			configMaps = append(configMaps, podConfigMaps...)
+			secrets = append(secrets, podSecrets...)
+		}
+	}
+
+	slices.Sort(configMaps)
+	configMaps = slices.Compact(configMaps)
+	for _, name := range configMaps {
+		obj, err := a.clientset.CoreV1().ConfigMaps(a.config.Resource.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			// References can be optional.
+			a.warn(lg, "ConfigMap not found", "name", name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get configmap %s: %w", name, err)
+		}
+		if err := writeManifestObject(&b, obj, corev1.SchemeGroupVersion.WithKind("ConfigMap")); err != nil {
+			return err
+		}
+	}
+
+	slices.Sort(secrets)
+	secrets = slices.Compact(secrets)
+	for _, name := range secrets {
+		obj, err := a.clientset.CoreV1().Secrets(a.config.Resource.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			a.warn(lg, "Secret not found", "name", name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get secret %s: %w", name, err)
+		}
+		if err := writeManifestObject(&b, obj, corev1.SchemeGroupVersion.WithKind("Secret")); err != nil {
+			return err
+		}
+	}
+
+	a.manifest = b.Bytes()
+	lg.Info("Successfuly fetched manifest", "configmaps", len(configMaps), "secrets", len(secrets))
+
+	return nil
+}
+
+func (a *Application) resourceGroupVersion(res *resource) schema.GroupVersion {
+	if a.customResources() {
+		return schema.GroupVersion{
+			Group:   a.config.Resource.APIGroup,
+			Version: a.config.Resource.APIVersion,
+		}
+	}
+	if res.Kind == "CronJob" {
+		return batchv1.SchemeGroupVersion
+	}
+	return appsv1.SchemeGroupVersion
+}
+
+// getObject returns the resource and its pod template, which is nil for custom resources.
+// Status is cleared, since it can't be applied anyway.
+func (a *Application) getObject(ctx context.Context, res *resource) (obj manifestObject, template *corev1.PodTemplateSpec, err error) {
+	ns := a.config.Resource.Namespace
+
+	if a.customResources() {
+		o, err := a.customResource(res.Type).Get(ctx, res.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		unstructured.RemoveNestedField(o.Object, "status")
+		return o, nil, nil
+	}
+
+	switch res.Kind {
+	case "Deployment":
+		o, err := a.clientset.AppsV1().Deployments(ns).Get(ctx, res.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		o.Status = appsv1.DeploymentStatus{}
+		return o, &o.Spec.Template, nil
+	case "StatefulSet":
+		o, err := a.clientset.AppsV1().StatefulSets(ns).Get(ctx, res.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		o.Status = appsv1.StatefulSetStatus{}
+		return o, &o.Spec.Template, nil
+	case "ReplicaSet":
+		o, err := a.clientset.AppsV1().ReplicaSets(ns).Get(ctx, res.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		o.Status = appsv1.ReplicaSetStatus{}
+		return o, &o.Spec.Template, nil
+	case "DaemonSet":
+		o, err := a.clientset.AppsV1().DaemonSets(ns).Get(ctx, res.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		o.Status = appsv1.DaemonSetStatus{}
+		return o, &o.Spec.Template, nil
+	case "CronJob":
+		o, err := a.clientset.BatchV1().CronJobs(ns).Get(ctx, res.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		o.Status = batchv1.CronJobStatus{}
+		return o, &o.Spec.JobTemplate.Spec.Template, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported kind %s", res.Kind)
+	}
+}
+
+// writeManifestObject writes the object as a YAML document without server-populated fields,
+// so that it can be applied to recreate the object.
+func writeManifestObject(b *bytes.Buffer, obj manifestObject, gvk schema.GroupVersionKind) (err error) {
+	// Typed clients don't set the type meta.
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+
+	obj.SetUID("")
+	obj.SetResourceVersion("")
+	obj.SetGeneration(0)
+	obj.SetCreationTimestamp(metav1.Time{})
+	obj.SetManagedFields(nil)
+	obj.SetOwnerReferences(nil)
+
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s %s: %w", gvk.Kind, obj.GetName(), err)
+	}
+
+	if b.Len() != 0 {
+		b.WriteString("---\n")
+	}
+	b.Write(data)
+
+	return nil
+}
+
+// podReferences returns names of ConfigMaps and Secrets referenced by the pod spec.
+func podReferences(spec *corev1.PodSpec) (configMaps, secrets []string) {
+	for i := range spec.Volumes {
+		vol := &spec.Volumes[i]
+		switch {
+		case vol.ConfigMap != nil:
+			configMaps = append(configMaps, vol.ConfigMap.Name)
+		case vol.Secret != nil:
+			secrets = append(secrets, vol.Secret.SecretName)
+		case vol.Projected != nil:
+			for _, src := range vol.Projected.Sources {
+				if src.ConfigMap != nil {
+					configMaps = append(configMaps, src.ConfigMap.Name)
+				}
+				if src.Secret != nil {
+					secrets = append(secrets, src.Secret.Name)
+				}
+			}
+		}
+	}
+
+	for _, ref := range spec.ImagePullSecrets {
+		secrets = append(secrets, ref.Name)
+	}
+
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for i := range containers {
+			c := &containers[i]
+			for _, src := range c.EnvFrom {
+				if src.ConfigMapRef != nil {
+					configMaps = append(configMaps, src.ConfigMapRef.Name)
+				}
+				if src.SecretRef != nil {
+					secrets = append(secrets, src.SecretRef.Name)
+				}
+			}
+			for _, env := range c.Env {
+				if env.ValueFrom == nil {
+					continue
+				}
+				if env.ValueFrom.ConfigMapKeyRef != nil {
+					configMaps = append(configMaps, env.ValueFrom.ConfigMapKeyRef.Name)
+				}
+				if env.ValueFrom.SecretKeyRef != nil {
+					secrets = append(secrets, env.ValueFrom.SecretKeyRef.Name)
+				}
+			}
+		}
+	}
+
+	return configMaps, secrets
+}
+
+func writeManifest(tw *tar.Writer, manifest []byte) (err error) {
+	header := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       manifestName,
+		Size:       int64(len(manifest)),
+		Mode:       0o600,
+		ModTime:    time.Now(),
+		PAXRecords: map[string]string{manifestPAXRecord: "true"},
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err = tw.Write(manifest)
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics are exposed in Prometheus text format,
+// either by an HTTP server or by pushing them to a Pushgateway.
+type metrics struct {
+	mu          sync.Mutex
+	resource    string
+	namespace   string
+	lastSuccess time.Time
+	archiveSize int64
+	duration    time.Duration
+	failures    int
+}
+
+func (m *metrics) update(success bool, archiveSize int64, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if success {
+		m.lastSuccess = time.Now()
+	} else {
+		m.failures++
+	}
+	m.archiveSize = archiveSize
+	m.duration = duration
+}
+
+func (m *metrics) WriteTo(w io.Writer) (n int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := fmt.Sprintf("{resource=%s,namespace=%s}",
+		strconv.Quote(m.resource), strconv.Quote(m.namespace))
+
+	var b bytes.Buffer
+	write := func(name, typ, help string, value float64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, typ)
+		fmt.Fprintf(&b, "%s%s %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+	}
+
+	// Omit the timestamp if there were no successful backups,
+	// so that the Pushgateway keeps the previous one.
+	if !m.lastSuccess.IsZero() {
+		write("k8sbackup_last_success_timestamp", "gauge",
+			"Unix timestamp of the last successful backup.",
+			float64(m.lastSuccess.UnixMilli())/1000)
+	}
+	write("k8sbackup_archive_size_bytes", "gauge",
+		"Size of the last archive in bytes.",
+		float64(m.archiveSize))
+	write("k8sbackup_duration_seconds", "gauge",
+		"Duration of the last backup in seconds.",
+		m.duration.Seconds())
+	write("k8sbackup_failures_total", "counter",
+		"Number of failed backups.",
+		float64(m.failures))
+
+	return b.WriteTo(w)
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+func (a *Application) serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", a.metrics)
+
+	server := &http.Server{
+		Addr:              a.config.Metrics.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			a.lg.Error("Failed to serve metrics", "error", err)
+		}
+	}()
+}
+
+func (a *Application) pushMetrics() (err error) {
+	// Resource contains slashes, so it must be encoded.
+	url := fmt.Sprintf("%s/metrics/job/k8s-backup/namespace/%s/resource@base64/%s",
+		strings.TrimRight(a.config.Metrics.PushgatewayURL, "/"),
+		a.metrics.namespace,
+		base64.RawURLEncoding.EncodeToString([]byte(a.metrics.resource)))
+
+	var b bytes.Buffer
+	if _, err := a.metrics.WriteTo(&b); err != nil {
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+
+	// POST replaces only metrics with the same names,
+	// so the last success timestamp survives failed backups.
+	req, err := http.NewRequest(http.MethodPost, url, &b)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	client := http.Client{Timeout: 30 * time.Second}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, body)
+	}
+
+	return nil
+}
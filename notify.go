@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/caarlos0/env/v11"
+	"github.com/charmbracelet/log"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// result describes the outcome of a run,
+// each notification backend renders it in its own way.
+type result struct {
+	Restore            bool // otherwise the run is a backup
+	Success            bool
+	DryRun             bool
+	SkipScale          bool
+	Cluster            string
+	Node               string
+	Resources          []string
+	Namespace          string
+	ArchiveName        string
+	ArchiveSize        int64
+	Checksum           string
+	Key                string // of the archive in the primary destination, if stored there
+	DownloadURL        string
+	Snapshot           string
+	ResourceResults    []resourceResult // if the resources are backed up separately
+	Duration           time.Duration
+	FailedDestinations []string
+	Warnings           []string
+	Version            string
+	Err                error
+}
+
+// Operation returns "Backup" or "Restore", depending on what the run did.
+func (r *result) Operation() string {
+	if r.Restore {
+		return "Restore"
+	}
+	return "Backup"
+}
+
+// status is the overall outcome of a run.
+type status int
+
+const (
+	statusSuccess status = iota
+	statusWarning        // succeeded, but something went wrong along the way
+	statusFailure
+)
+
+func (s status) String() string {
+	switch s {
+	case statusSuccess:
+		return "success"
+	case statusWarning:
+		return "warning"
+	default:
+		return "failure"
+	}
+}
+
+func (a *Application) result(err error) *result {
+	var (
+		failed      []string
+		downloadURL string
+		key         string
+	)
+	if len(a.destinations) != 0 && a.destinations[0].err == nil && a.archiveName != "" && !a.config.DryRun {
+		key = a.destinations[0].archiveKey
+	}
+	for _, dst := range a.destinations {
+		if dst.err != nil {
+			failed = append(failed, dst.String())
+		} else if downloadURL == "" {
+			downloadURL = dst.downloadURL
+		}
+	}
+
+	return &result{
+		Restore:            a.config.Mode == "restore",
+		Success:            err == nil,
+		DryRun:             a.config.DryRun,
+		SkipScale:          a.config.Resource.SkipScale,
+		Cluster:            a.config.ClusterName,
+		Node:               a.config.NodeName,
+		Resources:          a.config.Resource.IDs,
+		Namespace:          a.config.Resource.Namespace,
+		ArchiveName:        a.archiveName,
+		ArchiveSize:        a.archiveSize,
+		Checksum:           a.archiveChecksum,
+		Key:                key,
+		DownloadURL:        downloadURL,
+		Snapshot:           a.snapshotID,
+		ResourceResults:    a.resourceResults,
+		Duration:           a.duration,
+		FailedDestinations: failed,
+		Warnings:           a.collectedWarnings(),
+		Version:            version,
+		Err:                err,
+	}
+}
+
+// Partial reports whether the run has succeeded,
+// but the archive hasn't been uploaded to some of the destinations.
+func (r *result) Partial() bool {
+	return r.Success && len(r.FailedDestinations) != 0
+}
+
+// Status returns the overall outcome of the run.
+func (r *result) Status() status {
+	switch {
+	case !r.Success:
+		return statusFailure
+	case r.Partial() || len(r.Warnings) != 0:
+		return statusWarning
+	default:
+		return statusSuccess
+	}
+}
+
+// warn logs the warning and records it, so that it is included in notifications.
+func (a *Application) warn(lg *log.Logger, msg string, keyvals ...any) {
+	lg.Warn(msg, keyvals...)
+
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+	}
+
+	a.warningsMu.Lock()
+	defer a.warningsMu.Unlock()
+
+	a.warnings = append(a.warnings, b.String())
+}
+
+func (a *Application) collectedWarnings() []string {
+	a.warningsMu.Lock()
+	defer a.warningsMu.Unlock()
+
+	return slices.Clone(a.warnings)
+}
+
+// summary returns lines describing the run besides its status.
+func (r *result) summary() []string {
+	var lines []string
+
+	if r.Cluster != "" {
+		lines = append(lines, fmt.Sprintf("Cluster: %s", r.Cluster))
+	}
+	if r.Node != "" {
+		lines = append(lines, fmt.Sprintf("Node: %s", r.Node))
+	}
+
+	if r.SkipScale {
+		lines = append(lines, "No scaling occurred")
+	}
+
+	lines = append(lines, r.resourceSummary()...)
+
+	if r.ArchiveName != "" {
+		if r.DryRun {
+			lines = append(lines, fmt.Sprintf("Estimated tarball size: %s", byteCountIEC(r.ArchiveSize)))
+		} else {
+			lines = append(lines, fmt.Sprintf("Tarball size: %s", byteCountIEC(r.ArchiveSize)))
+		}
+	}
+
+	if r.Snapshot != "" {
+		lines = append(lines, fmt.Sprintf("Volume snapshot: %s", r.Snapshot))
+	}
+
+	if len(r.FailedDestinations) != 0 {
+		lines = append(lines, fmt.Sprintf("Failed destinations: %s", strings.Join(r.FailedDestinations, ", ")))
+	}
+
+	lines = append(lines, fmt.Sprintf("Duration: %s", humanizeDuration(r.Duration)))
+	lines = append(lines, fmt.Sprintf("Version: %s", r.Version))
+
+	return lines
+}
+
+func (a *Application) notify(err error) {
+	res := a.result(err)
+	if a.tgBot != nil {
+		a.notifyTelegram(res)
+	}
+	if a.config.Slack.WebhookURL != "" {
+		a.notifySlack(res)
+	}
+	if a.config.Webhook.URL != "" {
+		a.notifyWebhook(res)
+	}
+}
+
+// reportSetupFailure logs the error and sends the failure notification
+// when the application couldn't be set up, so that misconfiguration doesn't go unnoticed.
+// Only the notification settings have to be valid, the rest of the config can be invalid or even unparsable.
+func reportSetupFailure(setupErr error) {
+	a := new(Application)
+
+	if err := a.config.Load(); err != nil {
+		// Some unrelated option might be malformed, so try to parse just the notification settings.
+		a.config = Config{}
+		if err := env.ParseWithOptions(&a.config.Telegram, env.Options{Prefix: "TELEGRAM_"}); err != nil {
+			a.config.Telegram = TelegramConfig{}
+		}
+		if err := env.ParseWithOptions(&a.config.Slack, env.Options{Prefix: "SLACK_"}); err != nil {
+			a.config.Slack = SlackConfig{}
+		}
+		if err := env.ParseWithOptions(&a.config.Webhook, env.Options{Prefix: "WEBHOOK_"}); err != nil {
+			a.config.Webhook = WebhookConfig{}
+		}
+	}
+
+	a.config.Telegram.Normalize()
+
+	a.setupLogger()
+	a.lg.Error("Failed to setup application", "error", setupErr)
+
+	for _, id := range a.config.Resource.IDs {
+		if strings.Contains(id, "/") {
+			a.resources = append(a.resources, parseResource(id))
+		}
+	}
+
+	if a.config.Telegram.BotToken != "" && a.config.Telegram.Validate() == nil {
+		bot, err := tgbotapi.NewBotAPI(a.config.Telegram.BotToken)
+		if err != nil {
+			a.lg.Error("Failed to create Telegram Bot API", "error", err)
+		} else {
+			a.tgBot = bot
+			if a.config.Telegram.Template != "" {
+				a.tgTemplate, _ = parseTelegramTemplate(a.config.Telegram.Template, a.config.Telegram.ParseMode)
+			}
+		}
+	}
+	if a.config.Slack.Validate() != nil {
+		a.config.Slack = SlackConfig{}
+	}
+	if a.config.Webhook.Validate() != nil {
+		a.config.Webhook = WebhookConfig{}
+	}
+
+	a.notify(setupErr)
+}
+
+// Telegram doesn't accept messages and captions of documents longer than these.
+const (
+	telegramMessageLimit = 4096
+	telegramCaptionLimit = 1024
+)
+
+func (a *Application) notifyTelegram(res *result) {
+	log.Info("Sending Telegram notification")
+
+	f := newTelegramFormat(a.config.Telegram.ParseMode)
+
+	var b strings.Builder
+	if a.tgTemplate != nil {
+		if err := a.tgTemplate.Execute(&b, res); err != nil {
+			log.Error("Failed to render Telegram template, using the default one", "error", err)
+			b.Reset()
+		}
+	}
+	if b.Len() == 0 {
+		a.writeTelegramHeader(&b, f, res)
+	}
+
+	header := b.String()
+	logData := a.logData.String()
+
+	b.WriteString(f.escape("\nLog output was:\n"))
+	b.WriteString(f.pre(logData))
+
+	var msg tgbotapi.Chattable
+	if utf8.RuneCountInString(b.String()) <= a.config.Telegram.LogThreshold {
+		msg = a.telegramMessage(f, b.String())
+	} else {
+		// Log is too large to be sent inline, so send it as a compressed document.
+		logGzip, err := gzipBytes([]byte(logData))
+		if err != nil {
+			a.telegramFailed(res, fmt.Errorf("failed to compress log: %w", err))
+			return
+		}
+		doc := tgbotapi.NewDocument(a.config.Telegram.ChatID, tgbotapi.FileBytes{
+			Name:  strings.ToLower(res.Operation()) + ".log.gz",
+			Bytes: logGzip,
+		})
+		doc.Caption = header + f.escape("\nLog output is attached")
+		doc.ParseMode = f.parseMode
+
+		// The header can be long enough on its own, e.g. with many warnings,
+		// so it is sent as a message followed by the log with a short caption.
+		if utf8.RuneCountInString(doc.Caption) > telegramCaptionLimit {
+			if err := a.sendTelegram(a.telegramMessage(f, header)); err != nil {
+				a.telegramFailed(res, err)
+				return
+			}
+			doc.Caption = f.escape("Log output of the " + strings.ToLower(res.Operation()) + " of " + a.resourceNames(", "))
+		}
+
+		msg = doc
+	}
+
+	if err := a.sendTelegram(msg); err != nil {
+		a.telegramFailed(res, err)
+	}
+}
+
+// telegramMessage returns the text message to the configured chat.
+func (a *Application) telegramMessage(f *telegramFormat, text string) tgbotapi.MessageConfig {
+	return tgbotapi.MessageConfig{
+		BaseChat: tgbotapi.BaseChat{
+			ChatID:           a.config.Telegram.ChatID,
+			ReplyToMessageID: 0,
+		},
+		Text:      text,
+		ParseMode: f.parseMode,
+	}
+}
+
+// Delay before the first Telegram send retry, doubled after each retry.
+var telegramBackoff = time.Second
+
+// sendTelegram sends the message, retrying up to TELEGRAM_RETRIES times
+// on network errors, rate limiting and server errors.
+func (a *Application) sendTelegram(msg tgbotapi.Chattable) (err error) {
+	backoff := telegramBackoff
+
+	for attempt := 0; ; attempt++ {
+		_, err = a.tgBot.Send(msg)
+		if err == nil || attempt == a.config.Telegram.Retries {
+			return err
+		}
+
+		var tgErr *tgbotapi.Error
+		if errors.As(err, &tgErr) {
+			if tgErr.Code != http.StatusTooManyRequests && tgErr.Code < 500 {
+				return err
+			}
+			if tgErr.RetryAfter != 0 {
+				backoff = max(backoff, time.Duration(tgErr.RetryAfter)*time.Second)
+			}
+		}
+
+		log.Warn("Failed to send Telegram notification, retrying",
+			"attempt", attempt+1,
+			"backoff", backoff,
+			"error", err,
+		)
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Prefix of the alert written to stderr when the Telegram notification couldn't be sent,
+// the log is written to stdout, so the alert can be picked up separately.
+const notificationFailedMarker = "K8S-BACKUP-NOTIFICATION-FAILED"
+
+// telegramFailed writes the outcome of the run to stderr, since the notification
+// might be the only way it would have been noticed, and makes the process exit
+// with TELEGRAM_FAILURE_EXIT_CODE, if it would have succeeded otherwise.
+func (a *Application) telegramFailed(res *result, err error) {
+	log.Error("Failed to send Telegram notification", "error", err)
+
+	alert := fmt.Sprintf("%s: %s of %s: %s", notificationFailedMarker, strings.ToLower(res.Operation()), a.resourceNames(", "), res.Status())
+	if res.Err != nil {
+		alert += ": " + res.Err.Error()
+	}
+	fmt.Fprintf(os.Stderr, "%s (telegram error: %v)\n", alert, err)
+
+	a.tgFailed = true
+}
+
+// Warnings listed in the default message are limited,
+// so that it fits into a single message, the rest of them are in the log anyway.
+const (
+	telegramMaxWarnings      = 10
+	telegramMaxWarningLength = 300
+)
+
+// truncateRunes returns s cut to at most n characters, ending with an ellipsis if cut.
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n-1]) + "…"
+}
+
+// writeTelegramHeader writes the default message describing the run.
+func (a *Application) writeTelegramHeader(b *strings.Builder, f *telegramFormat, res *result) {
+	if res.DryRun {
+		b.WriteString(f.bold(f.escape("[DRY RUN]")) + " ")
+	}
+
+	// Custom emojis are available only in HTML.
+	successEmoji, failureEmoji := "🐳", "👾"
+	if f.parseMode == "HTML" {
+		successEmoji = `<tg-emoji emoji-id="5431815452437257407">🐳</tg-emoji>`
+		failureEmoji = `<tg-emoji emoji-id="5370869711888194012">👾</tg-emoji>`
+	}
+
+	names := f.escape(a.resourceNames(", "))
+	if res.Partial() {
+		fmt.Fprintf(b, "⚠️ %s of %s has %s\n", res.Operation(), names, f.bold("partially succeeded"))
+	} else if res.Status() == statusWarning {
+		fmt.Fprintf(b, "⚠️ %s of %s has %s\n", res.Operation(), names, f.bold("succeeded with warnings"))
+	} else if res.Success {
+		fmt.Fprintf(b, "%s %s of %s has %s\n", successEmoji, res.Operation(), names, f.bold("succeeded"))
+	} else {
+		fmt.Fprintf(b, "%s %s of %s has %s\n", failureEmoji, res.Operation(), names, f.bold("failed"))
+	}
+
+	for _, line := range res.summary() {
+		b.WriteString(f.escape(line))
+		b.WriteByte('\n')
+	}
+
+	if len(res.Warnings) != 0 {
+		b.WriteString(f.escape("Warnings:") + "\n")
+		for i, warning := range res.Warnings {
+			if i == telegramMaxWarnings {
+				b.WriteString(f.escape(fmt.Sprintf("• and %d more, see the log", len(res.Warnings)-i)) + "\n")
+				break
+			}
+			fmt.Fprintf(b, "• %s\n", f.escape(truncateRunes(warning, telegramMaxWarningLength)))
+		}
+	}
+
+	if res.DownloadURL != "" {
+		b.WriteString(f.link("Download", res.DownloadURL) + "\n")
+	}
+}
+
+// parseTelegramTemplate parses the message template, which is rendered against the result.
+func parseTelegramTemplate(text, parseMode string) (tmpl *template.Template, err error) {
+	return template.New("telegram").Funcs(template.FuncMap{
+		"bytes":    byteCountIEC,
+		"duration": humanizeDuration,
+		"join":     strings.Join,
+		"escape":   newTelegramFormat(parseMode).escape,
+	}).Parse(text)
+}
+
+func gzipBytes(data []byte) (compressed []byte, err error) {
+	var b bytes.Buffer
+
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+type webhookPayload struct {
+	Operation          string            `json:"operation"`
+	Success            bool              `json:"success"`
+	Partial            bool              `json:"partial"`
+	Status             string            `json:"status"`
+	DryRun             bool              `json:"dry_run"`
+	Cluster            string            `json:"cluster,omitempty"`
+	Node               string            `json:"node,omitempty"`
+	Resource           string            `json:"resource"`
+	Namespace          string            `json:"namespace"`
+	ArchiveName        string            `json:"archive_name,omitempty"`
+	ArchiveSizeBytes   int64             `json:"archive_size_bytes"`
+	Checksum           string            `json:"checksum,omitempty"`
+	Key                string            `json:"key,omitempty"`
+	DownloadURL        string            `json:"download_url,omitempty"`
+	Snapshot           string            `json:"snapshot,omitempty"`
+	Resources          []webhookResource `json:"resources,omitempty"`
+	DurationSeconds    float64           `json:"duration_seconds"`
+	FailedDestinations []string          `json:"failed_destinations,omitempty"`
+	Warnings           []string          `json:"warnings,omitempty"`
+	Version            string            `json:"version"`
+	Error              string            `json:"error,omitempty"`
+}
+
+// webhookResource is the outcome for one of the resources backed up separately.
+type webhookResource struct {
+	Resource         string `json:"resource"`
+	Status           string `json:"status"`
+	ArchiveName      string `json:"archive_name,omitempty"`
+	ArchiveSizeBytes int64  `json:"archive_size_bytes"`
+	Error            string `json:"error,omitempty"`
+}
+
+func (a *Application) notifyWebhook(res *result) {
+	log.Info("Sending webhook notification")
+
+	if err := postJSON(a.config.Webhook.URL, newWebhookPayload(res)); err != nil {
+		log.Error("Failed to send webhook notification", "error", err)
+	}
+}
+
+// newWebhookPayload returns the machine-readable outcome of the run,
+// which is also written to RESULT_FILE.
+func newWebhookPayload(res *result) *webhookPayload {
+	payload := &webhookPayload{
+		Operation:          strings.ToLower(res.Operation()),
+		Success:            res.Success,
+		Partial:            res.Partial(),
+		Status:             res.Status().String(),
+		DryRun:             res.DryRun,
+		Cluster:            res.Cluster,
+		Node:               res.Node,
+		Resource:           strings.Join(res.Resources, ","),
+		Namespace:          res.Namespace,
+		ArchiveName:        res.ArchiveName,
+		ArchiveSizeBytes:   res.ArchiveSize,
+		Checksum:           res.Checksum,
+		Key:                res.Key,
+		DownloadURL:        res.DownloadURL,
+		Snapshot:           res.Snapshot,
+		DurationSeconds:    res.Duration.Seconds(),
+		FailedDestinations: res.FailedDestinations,
+		Warnings:           res.Warnings,
+		Version:            res.Version,
+	}
+	if res.Err != nil {
+		payload.Error = res.Err.Error()
+	}
+	for _, r := range res.ResourceResults {
+		resource := webhookResource{
+			Resource:         r.ID,
+			Status:           r.Status.String(),
+			ArchiveName:      r.ArchiveName,
+			ArchiveSizeBytes: r.ArchiveSize,
+		}
+		if r.Err != nil {
+			resource.Error = r.Err.Error()
+		}
+		payload.Resources = append(payload.Resources, resource)
+	}
+
+	return payload
+}
+
+// writeResultFile writes the outcome of the run to RESULT_FILE,
+// so that e.g. the next step of a CI pipeline can parse it.
+func (a *Application) writeResultFile(res *result) (err error) {
+	data, err := json.MarshalIndent(newWebhookPayload(res), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal result: %w", err)
+	}
+	data = append(data, '\n')
+
+	if err := os.WriteFile(a.config.ResultFile, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write result file: %w", err)
+	}
+
+	return nil
+}
+
+func postJSON(url string, v any) (err error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, body)
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/charmbracelet/log"
+	"github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// telegramRequest is a request received by the fake Telegram Bot API.
+type telegramRequest struct {
+	method  string // e.g. sendMessage
+	text    string
+	caption string
+}
+
+// newTestTelegram returns the application sending notifications to a fake Telegram Bot API,
+// which records the requests and responds to them with the given HTTP status.
+func newTestTelegram(t *testing.T, status int) (a *Application, requests func() []telegramRequest) {
+	t.Helper()
+
+	var (
+		mu       sync.Mutex
+		received []telegramRequest
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			t.Error(err)
+		}
+		mu.Lock()
+		received = append(received, telegramRequest{
+			method:  r.URL.Path[strings.LastIndexByte(r.URL.Path, '/')+1:],
+			text:    r.FormValue("text"),
+			caption: r.FormValue("caption"),
+		})
+		mu.Unlock()
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"ok":false,"error_code":%d,"description":"%s"}`, status, http.StatusText(status))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	bot := &tgbotapi.BotAPI{Token: "token", Client: srv.Client(), Buffer: 100}
+	bot.SetAPIEndpoint(srv.URL + "/bot%s/%s")
+
+	a = &Application{
+		tgBot:     bot,
+		logData:   new(bytes.Buffer),
+		resources: []resource{parseResource("deployment/db")},
+	}
+	a.config.Telegram.ChatID = 1
+	a.config.Telegram.ParseMode = "HTML"
+	a.config.Telegram.LogThreshold = telegramMessageLimit
+
+	return a, func() []telegramRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(received)
+	}
+}
+
+func TestNotifyTelegramLongCaption(t *testing.T) {
+	tests := []struct {
+		name     string
+		warnings int
+		methods  []string
+	}{
+		{name: "short header", warnings: 1, methods: []string{"sendDocument"}},
+		{name: "many warnings", warnings: 100, methods: []string{"sendMessage", "sendDocument"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, requests := newTestTelegram(t, http.StatusOK)
+			a.logData.WriteString(strings.Repeat("log line\n", 1000))
+			for range tt.warnings {
+				a.warnings = append(a.warnings, "Failed to push metrics error="+strings.Repeat("connection refused ", 10))
+			}
+
+			a.notifyTelegram(a.result(nil))
+
+			if a.tgFailed {
+				t.Fatal("notification failed")
+			}
+
+			got := requests()
+			if len(got) != len(tt.methods) {
+				t.Fatalf("got %d requests, want %d", len(got), len(tt.methods))
+			}
+			for i, req := range got {
+				if req.method != tt.methods[i] {
+					t.Errorf("request %d: got %s, want %s", i, req.method, tt.methods[i])
+				}
+				if n := utf8.RuneCountInString(req.caption); n > telegramCaptionLimit {
+					t.Errorf("request %d: caption of %d characters", i, n)
+				}
+				if n := utf8.RuneCountInString(req.text); n > telegramMessageLimit {
+					t.Errorf("request %d: text of %d characters", i, n)
+				}
+			}
+		})
+	}
+}
+
+func TestNotifyTelegramEscapesLog(t *testing.T) {
+	a, requests := newTestTelegram(t, http.StatusOK)
+
+	// E.g. an error response of S3, which is XML.
+	err := errors.New("failed to upload archive: <Error><Code>AccessDenied</Code></Error> & more")
+	lg := log.NewWithOptions(a.logData, log.Options{Formatter: log.TextFormatter})
+	lg.Error("Failed to upload archive", "error", err)
+
+	a.notifyTelegram(a.result(err))
+
+	if a.tgFailed {
+		t.Fatal("notification failed")
+	}
+
+	got := requests()
+	if len(got) != 1 || got[0].method != "sendMessage" {
+		t.Fatalf("got %v, want a single message", got)
+	}
+
+	text := got[0].text
+	for _, s := range []string{"&lt;Error&gt;", "&amp;"} {
+		if !strings.Contains(text, s) {
+			t.Errorf("message doesn't contain %q:\n%s", s, text)
+		}
+	}
+
+	start, end := strings.Index(text, "<pre>"), strings.LastIndex(text, "</pre>")
+	if start == -1 || end < start {
+		t.Fatalf("message has no log:\n%s", text)
+	}
+	if pre := text[start+len("<pre>") : end]; strings.Contains(pre, "<Error>") {
+		t.Errorf("log isn't escaped:\n%s", pre)
+	}
+}
+
+func TestNotifyTelegramRetriesAndReportsFailure(t *testing.T) {
+	backoff := telegramBackoff
+	telegramBackoff = time.Millisecond
+	t.Cleanup(func() { telegramBackoff = backoff })
+
+	a, requests := newTestTelegram(t, http.StatusInternalServerError)
+	a.config.Telegram.Retries = 2
+
+	// The alert is written to stderr, so that it can be picked up apart from the log.
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	a.notifyTelegram(a.result(nil))
+	os.Stderr = stderr
+	w.Close()
+
+	alert, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(requests()); n != 3 {
+		t.Errorf("got %d attempts, want 3", n)
+	}
+	if !a.tgFailed {
+		t.Error("failure isn't reported")
+	}
+	if !strings.HasPrefix(string(alert), notificationFailedMarker+": backup of db: success") {
+		t.Errorf("got alert %q", alert)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// getSelector returns the label selector of the resource's pods.
+func (a *Application) getSelector(ctx context.Context, res *resource) (selector string, err error) {
+	client, err := a.scaleClient(res)
+	if err != nil {
+		return "", err
+	}
+
+	var scale *autoscalingv1.Scale
+	err = a.retryK8s(ctx, func() (err error) {
+		scale, err = client.GetScale(ctx, res.Name, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get resource: %w", a.scaleError(res, err))
+	}
+
+	// Custom resources specify it by labelSelectorPath of the subresource, which is optional.
+	if scale.Status.Selector == "" {
+		return "", fmt.Errorf("scale subresource of %s has no selector", res.ID)
+	}
+
+	return scale.Status.Selector, nil
+}
+
+// checkDisruptionBudgets returns names of PodDisruptionBudgets
+// that would be breached if the given number of the resource's pods were gone.
+func (a *Application) checkDisruptionBudgets(ctx context.Context, res *resource, removed int) (breached []string, err error) {
+	lg := log.FromContext(ctx)
+	lg.Info("Trying to check pod disruption budgets")
+
+	selector, err := a.getSelector(ctx, res)
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := a.clientset.CoreV1().
+		Pods(a.config.Resource.Namespace).
+		List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	pdbs, err := a.clientset.PolicyV1().
+		PodDisruptionBudgets(a.config.Resource.Namespace).
+		List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pod disruption budgets: %w", err)
+	}
+
+	for i := range pdbs.Items {
+		pdb := &pdbs.Items[i]
+
+		pdbSelector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector of pod disruption budget %s: %w", pdb.Name, err)
+		}
+		// Empty selector matches no pods in policy/v1.
+		if pdbSelector.Empty() {
+			continue
+		}
+
+		selected := 0
+		for j := range pods.Items {
+			if pdbSelector.Matches(labels.Set(pods.Items[j].Labels)) {
+				selected++
+			}
+		}
+
+		// Any of the selected pods can be among the removed ones.
+		if disrupted := min(selected, removed); disrupted != 0 && int32(disrupted) > pdb.Status.DisruptionsAllowed {
+			breached = append(breached, pdb.Name)
+		}
+	}
+
+	lg.Info("Successfuly checked pod disruption budgets")
+
+	return breached, nil
+}
+
+// respectDisruptionBudgets warns if scaling the resource from the given number of replicas
+// to the scale target would breach PodDisruptionBudgets, or fails if RESOURCE_RESPECT_PDB is set.
+func (a *Application) respectDisruptionBudgets(ctx context.Context, res *resource, replicas int) (err error) {
+	lg := log.FromContext(ctx)
+
+	breached, err := a.checkDisruptionBudgets(ctx, res, replicas-a.scaleTarget())
+	if err != nil {
+		if a.config.Resource.RespectPDB {
+			return fmt.Errorf("failed to check pod disruption budgets: %w", err)
+		}
+		a.warn(lg, "Failed to check pod disruption budgets", "error", err)
+		return nil
+	}
+
+	if len(breached) == 0 {
+		return nil
+	}
+
+	if a.config.Resource.RespectPDB {
+		return fmt.Errorf("scaling down would breach pod disruption budgets: %s", strings.Join(breached, ", "))
+	}
+
+	a.warn(lg, "Scaling down will breach pod disruption budgets", "pdbs", strings.Join(breached, ","))
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCheckDisruptionBudgets(t *testing.T) {
+	tests := []struct {
+		name     string
+		allowed  int32
+		target   int
+		breached []string
+	}{
+		{name: "scale to zero", allowed: 1, target: 0, breached: []string{"db"}},
+		{name: "scale to target within budget", allowed: 1, target: 2},
+		{name: "scale to target beyond budget", allowed: 1, target: 1, breached: []string{"db"}},
+		{name: "scale to zero within budget", allowed: 3, target: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := []runtime.Object{
+				&policyv1.PodDisruptionBudget{
+					ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+					Spec: policyv1.PodDisruptionBudgetSpec{
+						Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+					},
+					Status: policyv1.PodDisruptionBudgetStatus{DisruptionsAllowed: tt.allowed},
+				},
+			}
+			for i := range 3 {
+				objects = append(objects, &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      fmt.Sprintf("db-%d", i),
+						Namespace: "default",
+						Labels:    map[string]string{"app": "db"},
+					},
+				})
+			}
+
+			cs := fake.NewClientset(objects...)
+			newFakeScale(cs, map[string]int32{"db": 3})
+
+			a := &Application{clientset: cs}
+			a.config.Resource.Namespace = "default"
+			a.config.Resource.ScaleTarget = tt.target
+
+			res := parseResource("deployment/db")
+			breached, err := a.checkDisruptionBudgets(context.Background(), &res, 3-a.scaleTarget())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(breached, tt.breached) {
+				t.Fatalf("got breached %v, want %v", breached, tt.breached)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+)
+
+// Annotations recording the last successful backup on the resource.
+const (
+	lastBackupTimeAnnotation = "k8s-backup/last-backup-time"
+	lastArchiveAnnotation    = "k8s-backup/last-archive"
+)
+
+// Timeout for recording the outcome on the resources.
+const recordTimeout = 30 * time.Second
+
+// record records the outcome of the backup on the resources
+// as events and annotations, if enabled.
+// It doesn't depend on the run context, so that failures caused by cancellation are recorded too.
+func (a *Application) record(err error) {
+	if !a.config.Resource.Events && !a.config.Resource.Annotate {
+		return
+	}
+
+	if a.config.DryRun {
+		a.lg.Info("Dry run: skipping recording backup on resources")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), recordTimeout)
+	defer cancel()
+
+	for i := range a.resources {
+		res := &a.resources[i]
+		lg := a.lg.With("resource", res.ID, "namespace", a.config.Resource.Namespace)
+		ctx := log.WithContext(ctx, lg)
+
+		if a.config.Resource.Events {
+			if err := a.createEvent(ctx, res, err); err != nil {
+				a.warn(lg, "Failed to create event", "error", err)
+			}
+		}
+
+		if a.config.Resource.Annotate && err == nil {
+			if err := a.annotate(ctx, res); err != nil {
+				a.warn(lg, "Failed to annotate resource", "error", err)
+			}
+		}
+	}
+}
+
+// createEvent creates an event referencing the resource,
+// so that the outcome is shown by kubectl describe.
+func (a *Application) createEvent(ctx context.Context, res *resource, backupErr error) (err error) {
+	lg := log.FromContext(ctx)
+	lg.Info("Trying to create event")
+
+	// Events are matched to the object by its UID.
+	obj, _, err := a.getObject(ctx, res)
+	if err != nil {
+		return fmt.Errorf("failed to get resource: %w", err)
+	}
+
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: res.Name + ".",
+			Namespace:    a.config.Resource.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      a.resourceGroupVersion(res).String(),
+			Kind:            res.Kind,
+			Namespace:       a.config.Resource.Namespace,
+			Name:            res.Name,
+			UID:             obj.GetUID(),
+			ResourceVersion: obj.GetResourceVersion(),
+		},
+		Source:              corev1.EventSource{Component: "k8s-backup"},
+		ReportingController: "k8s-backup",
+		FirstTimestamp:      metav1.NewTime(a.startTime),
+		LastTimestamp:       metav1.Now(),
+		Count:               1,
+	}
+
+	if backupErr == nil {
+		event.Type = corev1.EventTypeNormal
+		event.Reason = "BackupSucceeded"
+		event.Message = fmt.Sprintf("Backup %s has succeeded in %s", a.archiveName, humanizeDuration(a.duration))
+	} else {
+		event.Type = corev1.EventTypeWarning
+		event.Reason = "BackupFailed"
+		event.Message = fmt.Sprintf("Backup has failed: %s", backupErr)
+	}
+
+	_, err = a.clientset.CoreV1().
+		Events(a.config.Resource.Namespace).
+		Create(ctx, event, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+
+	lg.Info("Successfuly created event", "reason", event.Reason)
+
+	return nil
+}
+
+type (
+	objectForAnnotations struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+
+	objectForMetadata struct {
+		Metadata objectForAnnotations `json:"metadata"`
+	}
+)
+
+// annotate records the time and the name of the last successful backup in the resource's annotations.
+func (a *Application) annotate(ctx context.Context, res *resource) (err error) {
+	lg := log.FromContext(ctx)
+	lg.Info("Trying to annotate resource")
+
+	meta := objectForMetadata{
+		Metadata: objectForAnnotations{
+			Annotations: map[string]string{
+				lastBackupTimeAnnotation: a.startTime.UTC().Format(time.RFC3339),
+				lastArchiveAnnotation:    a.archiveName,
+			},
+		},
+	}
+
+	patch, err := json.Marshal(&meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal patch: %w", err)
+	}
+
+	if a.customResources() {
+		_, err = a.customResource(res.Type).Patch(ctx, res.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	} else {
+		var client rest.Interface = a.clientset.AppsV1().RESTClient()
+		if res.Kind == "CronJob" {
+			client = a.clientset.BatchV1().RESTClient()
+		}
+
+		_, err = client.
+			Patch(types.MergePatchType).
+			Namespace(a.config.Resource.Namespace).
+			Resource(res.Type).
+			Name(res.Name).
+			Body(patch).
+			DoRaw(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	lg.Info("Successfuly annotated resource")
+
+	return nil
+}
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/infastin/gorack/errdefer"
+	"github.com/klauspost/compress/zstd"
+	"github.com/minio/minio-go/v7"
+)
+
+// Restore downloads an archive from S3 and extracts it into the backup directories
+// while the workload is scaled down.
+func (a *Application) Restore(ctx context.Context) (err error) {
+	a.startTime = time.Now()
+	defer func() {
+		a.duration = time.Since(a.startTime)
+		a.lg.Info("Finished restore", "duration", humanizeDuration(a.duration))
+		a.health.setPhase("finished")
+
+		// Metrics and records describe backups, so only the outcome is reported.
+		if a.config.ResultFile != "" {
+			if err := a.writeResultFile(a.result(err)); err != nil {
+				a.lg.Error("Failed to write result file", "error", err)
+			}
+		}
+		a.notify(err)
+	}()
+
+	if a.config.DryRun {
+		a.lg.Warn("Running in dry run mode: nothing will be scaled or extracted")
+	}
+
+	if a.config.Lock.Enabled && !a.config.DryRun {
+		unlock, err := a.lock(log.WithContext(ctx, a.lg))
+		if err != nil {
+			a.lg.Error("Failed to acquire lock", "error", err)
+			return err
+		}
+		defer unlock()
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, time.Duration(a.config.Backup.Timeout))
+	defer cancel()
+
+	lg := a.lg.With(
+		"endpoint", a.config.S3.Endpoint,
+		"bucket", a.config.S3.Bucket,
+	)
+	ctx = log.WithContext(runCtx, lg)
+
+	start := time.Now()
+	a.health.setPhase("downloading")
+
+	// Download the archive before scaling down to reduce downtime.
+	dst := a.destinations[0]
+	if err := dst.withTimeout(ctx, func(ctx context.Context) error {
+		return a.download(ctx, dst)
+	}); err != nil {
+		lg.Error("Failed to download from S3", "error", err)
+		return fmt.Errorf("failed to download from S3: %w", err)
+	}
+
+	lg.Info("Finished downloading", "duration", humanizeDuration(time.Since(start)))
+	defer func() {
+		a.archiveFile.Close()
+		if err := os.Remove(a.archiveFile.Name()); err != nil {
+			a.warn(a.lg, "Failed to delete temporary archive file", "error", err)
+		}
+		if err := a.removeBaseArchives(); err != nil {
+			a.warn(a.lg, "Failed to delete temporary base archive files", "error", err)
+		}
+	}()
+
+	lg = a.lg.With(
+		"resources", a.config.Resource.IDs,
+		"namespace", a.config.Resource.Namespace,
+	)
+	ctx = log.WithContext(runCtx, lg)
+
+	if a.config.Resource.SkipScale {
+		lg.Info("Skipping scaling")
+	} else {
+		start := time.Now()
+		a.health.setPhase("scaling_down")
+
+		var scaleUp func(context.Context) error
+		scaleUp, err = a.scaleDown(ctx)
+		if err != nil {
+			lg.Error("Failed to scale down", "error", err)
+			return fmt.Errorf("failed to scale down: %w", err)
+		}
+
+		lg.Info("Finished scaling down", "duration", humanizeDuration(time.Since(start)))
+		defer func() {
+			if scaleErr := a.scaleUp(scaleUp); scaleErr != nil {
+				if err != nil {
+					err = fmt.Errorf("%w: %w", err, scaleErr)
+				} else {
+					err = scaleErr
+				}
+			}
+		}()
+	}
+
+	lg = a.lg.With(
+		"directories", a.config.Backup.Directories,
+		"file", a.archiveFile.Name(),
+	)
+	ctx = log.WithContext(runCtx, lg)
+
+	start = time.Now()
+	a.health.setPhase("extracting")
+
+	if len(a.baseArchives) != 0 {
+		if err := a.extractBases(ctx); err != nil {
+			lg.Error("Failed to extract base archives", "error", err)
+			return fmt.Errorf("failed to extract base archives: %w", err)
+		}
+	}
+
+	if err := a.extract(ctx); err != nil {
+		lg.Error("Failed to extract", "error", err)
+		return fmt.Errorf("failed to extract: %w", err)
+	}
+
+	lg.Info("Finished extracting", "duration", humanizeDuration(time.Since(start)))
+
+	return nil
+}
+
+// download downloads the archive specified by RESTORE_ARCHIVE,
+// or the latest one, to a temporary file and verifies its checksum.
+// The archives an incremental archive is based on are downloaded too.
+func (a *Application) download(ctx context.Context, dst *destination) (err error) {
+	lg := log.FromContext(ctx)
+
+	key := a.config.Restore.Archive
+	if key == "" {
+		lg.Info("Trying to find the latest archive")
+
+		archives, err := a.listArchives(ctx, dst)
+		if err != nil {
+			return err
+		}
+		if len(archives) == 0 {
+			return errors.New("no archives found")
+		}
+
+		key = archives[0].Key
+	}
+
+	bases, err := a.resolveChain(ctx, dst, key)
+	if err != nil {
+		return err
+	}
+
+	if len(bases) != 0 {
+		lg.Info("Archive is incremental, downloading the archives it is based on", "bases", len(bases))
+		defer errdefer.Close(&err, a.removeBaseArchives)
+
+		for _, base := range bases {
+			if err := a.downloadArchive(ctx, dst, base); err != nil {
+				return err
+			}
+			a.baseArchives = append(a.baseArchives, baseArchive{name: a.archiveName, file: a.archiveFile})
+		}
+	}
+
+	return a.downloadArchive(ctx, dst, key)
+}
+
+// downloadArchive downloads the archive to a temporary file and verifies its checksum.
+func (a *Application) downloadArchive(ctx context.Context, dst *destination, key string) (err error) {
+	lg := log.FromContext(ctx).With("key", key)
+	lg.Info("Downloading archive from S3")
+
+	obj, err := dst.client.GetObject(ctx, dst.config.Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get archive: %w", err)
+	}
+	defer obj.Close()
+
+	info, err := obj.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat archive: %w", err)
+	}
+
+	lg.Info("Got archive",
+		"size", byteCountIEC(info.Size),
+		"last_modified", info.LastModified,
+		"resource_kind", info.UserMetadata["Resource-Kind"],
+		"resource_name", info.UserMetadata["Resource-Name"],
+		"resource_replicas", info.UserMetadata["Resource-Replicas"],
+	)
+
+	name := path.Base(key)
+
+	file, err := os.Create(filepath.Join(a.config.Backup.TempDirectory(), name))
+	if err != nil {
+		return fmt.Errorf("failed to create archive file: %w", err)
+	}
+	defer errdefer.Close(&err, func() error {
+		file.Close()
+		return os.Remove(file.Name())
+	})
+
+	hash := sha256.New()
+	w := io.MultiWriter(file, hash, a.health)
+
+	var size int64
+	if strings.HasSuffix(name, chunksExtension) {
+		size, err = a.downloadChunks(ctx, dst, obj, w)
+	} else {
+		size, err = io.Copy(w, obj)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download archive: %w", err)
+	}
+
+	a.archiveName = name
+	dst.archiveKey = key
+	a.archiveFile = file
+	a.archiveSize = size
+	a.archiveChecksum = hex.EncodeToString(hash.Sum(nil))
+
+	lg.Info("Downloaded archive from S3", "size", byteCountIEC(a.archiveSize))
+
+	if a.config.Restore.VerifyChecksum {
+		if err := a.verifyChecksum(ctx, dst, info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyChecksum compares the checksum of the downloaded archive
+// with the one stored in its metadata or in the checksum file.
+func (a *Application) verifyChecksum(ctx context.Context, dst *destination, info minio.ObjectInfo) (err error) {
+	lg := log.FromContext(ctx)
+	lg.Info("Trying to verify archive checksum")
+
+	expected := info.UserMetadata[checksumMetadataKey]
+	if expected == "" {
+		expected, err = a.getChecksum(ctx, dst)
+		if err != nil {
+			return err
+		}
+	}
+
+	if expected != a.archiveChecksum {
+		return fmt.Errorf("archive checksum mismatch: expected %s, got %s", expected, a.archiveChecksum)
+	}
+
+	lg.Info("Successfuly verified archive checksum")
+
+	return nil
+}
+
+// getChecksum reads the archive checksum from the file uploaded along with the archive.
+func (a *Application) getChecksum(ctx context.Context, dst *destination) (checksum string, err error) {
+	obj, err := dst.client.GetObject(ctx, dst.config.Bucket, dst.archiveKey+".sha256", minio.GetObjectOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get archive checksum: %w", err)
+	}
+	defer obj.Close()
+
+	line, err := bufio.NewReader(obj).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return "", errors.New("archive has no checksum")
+		}
+		return "", fmt.Errorf("failed to read archive checksum: %w", err)
+	}
+
+	checksum, _, _ = strings.Cut(line, " ")
+	return checksum, nil
+}
+
+func (a *Application) extract(ctx context.Context) (err error) {
+	lg := log.FromContext(ctx)
+
+	tarReader, _, err := a.openArchive()
+	if err != nil {
+		return err
+	}
+
+	// Entries are prefixed with the directory's base name only when there are several of them.
+	prefixed := len(a.config.Backup.Directories) > 1
+	dirs := make(map[string]string, len(a.config.Backup.Directories))
+	for _, dir := range a.config.Backup.Directories {
+		dirs[filepath.Base(dir)] = dir
+	}
+
+	// resolve returns the path the entry is extracted to.
+	resolve := func(entryName string) (target string, ok bool, err error) {
+		name := path.Clean(entryName)
+		if !fs.ValidPath(name) {
+			return "", false, fmt.Errorf("%s: invalid entry name", entryName)
+		}
+
+		dir := a.config.Backup.Directories[0]
+		if prefixed {
+			var base string
+			base, name, _ = strings.Cut(name, "/")
+			if dir, ok = dirs[base]; !ok {
+				return "", false, nil
+			}
+		}
+
+		if err := checkParents(dir, name); err != nil {
+			return "", false, fmt.Errorf("%s: %w", entryName, err)
+		}
+
+		return filepath.Join(dir, filepath.FromSlash(name)), true, nil
+	}
+
+	if a.config.DryRun {
+		lg.Info("Dry run: checking archive")
+	} else {
+		lg.Info("Extracting archive")
+	}
+
+	// Modification times of directories are set at the end,
+	// since they change whenever their entries are extracted.
+	type dirTime struct {
+		name    string
+		modTime time.Time
+	}
+	var dirTimes []dirTime
+
+	entries := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		a.health.progress()
+
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		if header.PAXRecords[manifestPAXRecord] != "" {
+			lg.Info("Skipping manifest, apply it with kubectl if needed", "name", header.Name)
+			continue
+		}
+
+		if header.PAXRecords[infoPAXRecord] != "" {
+			lg.Info("Skipping backup info", "name", header.Name)
+			continue
+		}
+
+		if header.PAXRecords[streamEntryPAXRecord] != "" {
+			lg.Info("Skipping stream entry, restore it manually if needed", "name", header.Name)
+			continue
+		}
+
+		if header.PAXRecords[deletedPAXRecord] != "" {
+			if a.config.DryRun {
+				continue
+			}
+			removed, err := a.removeDeleted(tarReader, resolve)
+			if err != nil {
+				return fmt.Errorf("failed to remove deleted entries: %w", err)
+			}
+			lg.Info("Removed entries deleted since the previous backup", "removed", removed)
+			continue
+		}
+
+		target, ok, err := resolve(header.Name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			a.warn(lg, "Skipping entry of unknown directory", "name", header.Name)
+			continue
+		}
+
+		entries++
+		if a.config.DryRun {
+			continue
+		}
+
+		if err := extractEntry(tarReader, header, target); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", header.Name, err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			dirTimes = append(dirTimes, dirTime{target, header.ModTime})
+		}
+	}
+
+	for i := len(dirTimes) - 1; i >= 0; i-- {
+		// The directory might have been replaced by a symlink later in the archive.
+		if info, err := os.Lstat(dirTimes[i].name); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := os.Chtimes(dirTimes[i].name, time.Time{}, dirTimes[i].modTime); err != nil {
+			return fmt.Errorf("failed to set modification time of %s: %w", dirTimes[i].name, err)
+		}
+	}
+
+	if a.config.DryRun {
+		lg.Info("Dry run: skipping extraction", "entries", entries)
+	} else {
+		lg.Info("Extracted archive", "entries", entries)
+	}
+
+	return nil
+}
+
+// checkParents returns an error if any of the parents of the entry name inside dir is a symlink,
+// since the entry would be extracted or removed outside of dir through it.
+// This covers both symlinks extracted earlier from the archive and the ones already existing in dir.
+func checkParents(dir, name string) error {
+	parent := dir
+	parts := strings.Split(name, "/")
+	for _, part := range parts[:len(parts)-1] {
+		parent = filepath.Join(parent, part)
+
+		info, err := os.Lstat(parent)
+		if errors.Is(err, fs.ErrNotExist) {
+			// The rest is created by extraction.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("parent %s is a symlink", parent)
+		}
+	}
+	return nil
+}
+
+// archiveFormat describes how the tar inside an archive is encoded.
+type archiveFormat struct {
+	encrypted   bool
+	compression string // gzip, zstd or empty
+}
+
+// Magic bytes the compressed streams start with.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// formatFromName detects the format from the extensions of the archive name.
+// It reports false if they don't tell whether the archive is compressed,
+// e.g. if the archive has been renamed or restored by its key.
+func formatFromName(name string) (format archiveFormat, ok bool) {
+	name, format.encrypted = strings.CutSuffix(name, ".enc")
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		format.compression = "gzip"
+	case strings.HasSuffix(name, ".tar.zst"):
+		format.compression = "zstd"
+	case strings.HasSuffix(name, ".tar"):
+	default:
+		return format, false
+	}
+	return format, true
+}
+
+// sniffCompression detects the compression from the first bytes of the stream.
+// Tar headers start with the entry name, so they can't be mistaken for these.
+func sniffCompression(br *bufio.Reader) string {
+	magic, _ := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return "gzip"
+	case bytes.HasPrefix(magic, zstdMagic):
+		return "zstd"
+	default:
+		return ""
+	}
+}
+
+// openArchive returns the tar reader of the archive file from the beginning,
+// as well as the underlying reader of the decrypted and decompressed data.
+// Archives are encrypted and compressed or not regardless of the current config,
+// so the format is detected from the name, or from the data if the name doesn't tell.
+func (a *Application) openArchive() (tr *tar.Reader, r io.Reader, err error) {
+	if _, err := a.archiveFile.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, fmt.Errorf("failed to seek archive file: %w", err)
+	}
+
+	br := bufio.NewReader(a.archiveFile)
+
+	// Deduplicated archives are reassembled into a plain tar.
+	if strings.HasSuffix(a.archiveName, chunksExtension) {
+		return tar.NewReader(br), br, nil
+	}
+
+	format, ok := formatFromName(a.archiveName)
+	if !ok && !format.encrypted {
+		magic, _ := br.Peek(len(encMagic))
+		format.encrypted = string(magic) == encMagic
+	}
+
+	r = br
+	if format.encrypted {
+		if a.config.Backup.EncryptionKey == "" {
+			return nil, nil, errors.New("archive is encrypted, but no encryption key is specified")
+		}
+		r, err = newDecryptReader(br, a.config.Backup.EncryptionKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create decrypt reader: %w", err)
+		}
+	}
+
+	if !ok {
+		br = bufio.NewReader(r)
+		r = br
+		format.compression = sniffCompression(br)
+	}
+
+	switch format.compression {
+	case "gzip":
+		r, err = gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		}
+	case "zstd":
+		// A single goroutine is enough, since the data is read sequentially.
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create zstd reader: %w", err)
+		}
+		r = zr
+	}
+
+	return tar.NewReader(r), r, nil
+}
+
+// extractEntry extracts the entry the tar reader is positioned at to target.
+// Existing files are overwritten, existing directories are kept.
+func extractEntry(tr *tar.Reader, header *tar.Header, target string) (err error) {
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+
+	mode := header.FileInfo().Mode()
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		// Replace a symlink, so that we don't change the directory it points to.
+		if info, err := os.Lstat(target); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(target, 0o755); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		// Remove the old file, so that we don't write through a symlink.
+		if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if _, ok := header.PAXRecords[paxGNUSparseMajor]; ok {
+			// Restore holes of sparse files.
+			if _, err := io.Copy(&holeWriter{file: file}, tr); err != nil {
+				return err
+			}
+			if err := file.Truncate(header.Size); err != nil {
+				return err
+			}
+		} else {
+			if _, err := io.Copy(file, tr); err != nil {
+				return err
+			}
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := os.Symlink(header.Linkname, target); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported entry type %c", header.Typeflag)
+	}
+
+	// Restoring ownership requires privileges, which we might not have.
+	if err := os.Lchown(target, header.Uid, header.Gid); err != nil && !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+
+	if header.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+
+	// Mode must be set after the ownership, since chown clears setuid and setgid bits.
+	if err := os.Chmod(target, mode&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+
+	if header.Typeflag == tar.TypeReg {
+		if err := os.Chtimes(target, time.Time{}, header.ModTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// writeTestArchive writes a plain tar with the given entries and opens it for extraction.
+func writeTestArchive(t *testing.T, headers []*tar.Header, contents map[string]string) *os.File {
+	t.Helper()
+
+	file, err := os.Create(filepath.Join(t.TempDir(), "backup.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+
+	tw := tar.NewWriter(file)
+	for _, header := range headers {
+		content := contents[header.Name]
+		header.Size = int64(len(content))
+		if header.Mode == 0 {
+			header.Mode = 0o644
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+func newTestRestore(dir string, archive *os.File) *Application {
+	a := &Application{
+		archiveFile: archive,
+		archiveName: "backup.tar",
+		health:      newHealth(time.Minute),
+	}
+	a.config.Mode = "restore"
+	a.config.Backup.Directories = []string{dir}
+	return a
+}
+
+func TestExtractDoesNotFollowSymlinks(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  []*tar.Header
+		existing string // name of a symlink to the outside directory existing in the backup directory
+	}{
+		{
+			name: "symlink in archive",
+			headers: []*tar.Header{
+				{Name: "d", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+				{Name: "d/passwd", Typeflag: tar.TypeReg},
+			},
+		},
+		{
+			name: "nested symlink in archive",
+			headers: []*tar.Header{
+				{Name: "a", Typeflag: tar.TypeDir, Mode: 0o755},
+				{Name: "a/d", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+				{Name: "a/d/sub/passwd", Typeflag: tar.TypeReg},
+			},
+		},
+		{
+			name:     "existing symlink",
+			existing: "d",
+			headers: []*tar.Header{
+				{Name: "d/passwd", Typeflag: tar.TypeReg},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			outside := t.TempDir()
+
+			for _, header := range tt.headers {
+				if header.Linkname == "OUTSIDE" {
+					header.Linkname = outside
+				}
+			}
+			if tt.existing != "" {
+				if err := os.Symlink(outside, filepath.Join(dir, tt.existing)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			archive := writeTestArchive(t, tt.headers, map[string]string{
+				"d/passwd":       "root::0:0::/root:/bin/sh\n",
+				"a/d/sub/passwd": "root::0:0::/root:/bin/sh\n",
+			})
+
+			err := newTestRestore(dir, archive).extract(context.Background())
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			entries, err := os.ReadDir(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Fatalf("extracted outside of the directory: %s", entries[0].Name())
+			}
+		})
+	}
+}
+
+func TestExtractReplacesSymlinkWithDirectory(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+
+	if err := os.Chmod(outside, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "d")); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := writeTestArchive(t, []*tar.Header{
+		{Name: "d", Typeflag: tar.TypeDir, Mode: 0o777},
+		{Name: "d/file", Typeflag: tar.TypeReg},
+	}, map[string]string{"d/file": "data"})
+
+	if err := newTestRestore(dir, archive).extract(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o700 {
+		t.Fatalf("changed mode of the symlink target to %v", info.Mode().Perm())
+	}
+	if _, err := os.Stat(filepath.Join(outside, "file")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("extracted through the symlink: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d", "file")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFormatFromName(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   archiveFormat
+		wantOK bool
+	}{
+		{name: "backup.tar", wantOK: true},
+		{name: "backup.tar.gz", want: archiveFormat{compression: "gzip"}, wantOK: true},
+		{name: "backup.tgz", want: archiveFormat{compression: "gzip"}, wantOK: true},
+		{name: "backup.tar.zst", want: archiveFormat{compression: "zstd"}, wantOK: true},
+		{name: "backup.tar.enc", want: archiveFormat{encrypted: true}, wantOK: true},
+		{name: "backup.tar.gz.enc", want: archiveFormat{encrypted: true, compression: "gzip"}, wantOK: true},
+		{name: "backup.tar.zst.enc", want: archiveFormat{encrypted: true, compression: "zstd"}, wantOK: true},
+		{name: "backup.enc", want: archiveFormat{encrypted: true}},
+		{name: "backup"},
+		{name: "backup.gz"},
+		{name: "backup.tar.gz.sha256"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := formatFromName(tt.name)
+			if got != tt.want || ok != tt.wantOK {
+				t.Fatalf("got %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// compressTestData returns the data compressed with the compression.
+func compressTestData(t *testing.T, compression string, data []byte) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	var w io.WriteCloser
+	switch compression {
+	case "gzip":
+		w = gzip.NewWriter(&b)
+	case "zstd":
+		zw, err := zstd.NewWriter(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = zw
+	default:
+		return data
+	}
+
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestSniffCompression(t *testing.T) {
+	var tarData bytes.Buffer
+	tw := tar.NewWriter(&tarData)
+	if err := tw.WriteHeader(&tar.Header{Name: "file", Mode: 0o644, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "tar", data: tarData.Bytes()},
+		{name: "gzip", data: compressTestData(t, "gzip", tarData.Bytes()), want: "gzip"},
+		{name: "zstd", data: compressTestData(t, "zstd", tarData.Bytes()), want: "zstd"},
+		{name: "short", data: gzipMagic[:1]},
+		{name: "empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sniffCompression(bufio.NewReader(bytes.NewReader(tt.data))); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenArchiveDetectsFormat(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression string
+		encrypted   bool
+	}{
+		{name: "backup.tar"},
+		{name: "backup.tar.gz", compression: "gzip"},
+		{name: "backup.tar.zst", compression: "zstd"},
+		{name: "backup.tar.gz.enc", compression: "gzip", encrypted: true},
+		// Renamed archives are detected by their content.
+		{name: "backup", compression: "gzip"},
+		{name: "backup-zstd", compression: "zstd"},
+		{name: "backup-plain"},
+		{name: "backup-encrypted", compression: "zstd", encrypted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tarData bytes.Buffer
+			tw := tar.NewWriter(&tarData)
+			if err := tw.WriteHeader(&tar.Header{Name: "file", Mode: 0o644, Size: 4, Typeflag: tar.TypeReg}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte("data")); err != nil {
+				t.Fatal(err)
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			data := compressTestData(t, tt.compression, tarData.Bytes())
+			if tt.encrypted {
+				var b bytes.Buffer
+				ew, err := newEncryptWriter(&b, "secret")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := ew.Write(data); err != nil {
+					t.Fatal(err)
+				}
+				if err := ew.Close(); err != nil {
+					t.Fatal(err)
+				}
+				data = b.Bytes()
+			}
+
+			file, err := os.Create(filepath.Join(t.TempDir(), tt.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			if _, err := file.Write(data); err != nil {
+				t.Fatal(err)
+			}
+
+			a := newTestRestore(t.TempDir(), file)
+			a.archiveName = tt.name
+			a.config.Backup.EncryptionKey = "secret"
+
+			_, r, err := a.openArchive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entries := readTestArchive(t, r); entries["file"] != "data" {
+				t.Fatalf("got entries %v", entries)
+			}
+		})
+	}
+}
+
+func TestRestoreWritesResultFile(t *testing.T) {
+	a, scale := newTestRun(t)
+	a.config.Mode = "restore"
+	a.config.ResultFile = filepath.Join(t.TempDir(), "result.json")
+
+	// The bucket is empty, so there is nothing to restore.
+	dst, _ := newFakeS3(t)
+	a.destinations = []*destination{dst}
+
+	if err := a.Restore(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+	if replicas := scale.get("db"); replicas != 3 {
+		t.Fatalf("got %d replicas, want 3", replicas)
+	}
+
+	data, err := os.ReadFile(a.config.ResultFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Operation != "restore" || payload.Status != "failure" || payload.Error == "" {
+		t.Fatalf("got result %s", data)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+// Timeout for listing the resources matching the selector.
+const selectTimeout = 30 * time.Second
+
+type (
+	objectForOwners struct {
+		Name            string            `json:"name"`
+		OwnerReferences []json.RawMessage `json:"ownerReferences"`
+	}
+
+	objectForList struct {
+		Items []struct {
+			Metadata objectForOwners `json:"metadata"`
+		} `json:"items"`
+	}
+)
+
+// selectResources adds the resources of the selector type matching the selector
+// to the configured ones.
+// Resources owned by other resources, e.g. ReplicaSets of Deployments, are skipped,
+// since their owners would scale them back up.
+func (a *Application) selectResources() (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), selectTimeout)
+	defer cancel()
+
+	typ := parseResource(a.config.Resource.SelectorType + "/").Type
+
+	var client rest.Interface = a.clientset.AppsV1().RESTClient()
+	if typ == "cronjobs" {
+		client = a.clientset.BatchV1().RESTClient()
+	}
+
+	var data []byte
+	err = a.retryK8s(ctx, func() (err error) {
+		if a.customResources() {
+			list, err := a.customResource(typ).List(ctx, metav1.ListOptions{LabelSelector: a.config.Resource.Selector})
+			if err != nil {
+				return err
+			}
+			data, err = list.MarshalJSON()
+			return err
+		}
+		data, err = client.
+			Get().
+			Namespace(a.config.Resource.Namespace).
+			Resource(typ).
+			Param("labelSelector", a.config.Resource.Selector).
+			DoRaw(ctx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %w", typ, err)
+	}
+
+	var list objectForList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("failed to unmarshal %s: %w", typ, err)
+	}
+
+	for _, item := range list.Items {
+		if len(item.Metadata.OwnerReferences) != 0 {
+			continue
+		}
+		id := typ + "/" + item.Metadata.Name
+		if slices.ContainsFunc(a.resources, func(res resource) bool {
+			return res.Type == typ && res.Name == item.Metadata.Name
+		}) {
+			continue
+		}
+		a.resources = append(a.resources, parseResource(id))
+		a.config.Resource.IDs = append(a.config.Resource.IDs, id)
+	}
+
+	if len(a.resources) == 0 {
+		return fmt.Errorf("no %s match selector %q", typ, a.config.Resource.Selector)
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// resourceResult describes the outcome of backing up one of the resources backed up separately.
+type resourceResult struct {
+	ID          string
+	Status      status
+	ArchiveName string
+	ArchiveSize int64
+	Err         error
+}
+
+// separately reports whether each resource is backed up into its own archive.
+func (a *Application) separately() bool {
+	return a.config.Backup.Concurrency != 0
+}
+
+// forResource returns the application backing up only the resource,
+// whose outcome is reported by a instead of being notified about.
+func (a *Application) forResource(res resource) *Application {
+	child := &Application{
+		clientset:     a.clientset,
+		dynamicClient: a.dynamicClient,
+		restConfig:    a.restConfig,
+		resources:     []resource{res},
+		config:        a.config,
+		fsDest:        a.fsDest,
+		lg:            a.lg,
+		logData:       a.logData,
+		health:        a.health,
+		location:      a.location,
+		child:         true,
+	}
+
+	child.config.Resource.IDs = []string{res.ID}
+	child.config.Backup.Concurrency = 0
+	child.config.Backup.Directories = make([]string, len(a.config.Backup.Directories))
+	for i, dir := range a.config.Backup.Directories {
+		child.config.Backup.Directories[i] = strings.ReplaceAll(dir, "{resource}", res.Name)
+	}
+	// Metrics are exposed and pushed by a for all the resources.
+	child.config.Metrics = MetricsConfig{}
+	child.metrics = &metrics{
+		resource:  res.ID,
+		namespace: a.config.Resource.Namespace,
+	}
+
+	for _, dst := range a.destinations {
+		child.destinations = append(child.destinations, &destination{
+			config:     dst.config,
+			client:     dst.client,
+			encryption: dst.encryption,
+		})
+	}
+
+	child.archiveRegexp = child.archiveNameRegexp()
+
+	return child
+}
+
+// runSeparately backs up each resource into its own archive,
+// at most BACKUP_CONCURRENCY of them at a time.
+func (a *Application) runSeparately(ctx context.Context) (err error) {
+	children := make([]*Application, len(a.resources))
+	errs := make([]error, len(a.resources))
+
+	var g errgroup.Group
+	g.SetLimit(a.config.Backup.Concurrency)
+
+	for i := range a.resources {
+		children[i] = a.forResource(a.resources[i])
+		g.Go(func() error {
+			errs[i] = children[i].Run(ctx)
+			return nil
+		})
+	}
+
+	g.Wait()
+
+	var failed []error
+	for i, child := range children {
+		res := &a.resources[i]
+		// The replicas are reported in notifications and metadata of the child only.
+		res.Replicas = child.resources[0].Replicas
+
+		result := resourceResult{
+			ID:          res.ID,
+			Status:      child.result(errs[i]).Status(),
+			ArchiveName: child.archiveName,
+			ArchiveSize: child.archiveSize,
+			Err:         errs[i],
+		}
+		a.resourceResults = append(a.resourceResults, result)
+		a.archiveSize += child.archiveSize
+
+		for _, warning := range child.collectedWarnings() {
+			a.warningsMu.Lock()
+			a.warnings = append(a.warnings, res.ID+": "+warning)
+			a.warningsMu.Unlock()
+		}
+		for j, dst := range child.destinations {
+			if dst.err != nil && a.destinations[j].err == nil {
+				a.destinations[j].err = dst.err
+			}
+		}
+
+		if errs[i] != nil {
+			failed = append(failed, fmt.Errorf("%s: %w", res.ID, errs[i]))
+		}
+	}
+
+	if len(failed) != 0 {
+		return fmt.Errorf("failed to back up %d of %d resources: %w", len(failed), len(children), errors.Join(failed...))
+	}
+
+	return nil
+}
+
+// resourceSummary returns lines describing the outcome for each resource backed up separately.
+func (r *result) resourceSummary() []string {
+	lines := make([]string, 0, len(r.ResourceResults))
+	for _, res := range r.ResourceResults {
+		line := fmt.Sprintf("%s: %s", res.ID, res.Status)
+		if res.ArchiveName != "" {
+			line += fmt.Sprintf(", %s", byteCountIEC(res.ArchiveSize))
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/log"
+)
+
+type slackMessage struct {
+	Channel string `json:"channel,omitempty"`
+	Text    string `json:"text"`
+}
+
+// Slack requires these characters to be escaped in messages.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func (a *Application) notifySlack(res *result) {
+	log.Info("Sending Slack notification")
+
+	if err := postJSON(a.config.Slack.WebhookURL, &slackMessage{
+		Channel: a.config.Slack.Channel,
+		Text:    a.slackText(res),
+	}); err != nil {
+		log.Error("Failed to send Slack notification", "error", err)
+	}
+}
+
+// slackText renders the message describing the run in Slack's mrkdwn.
+func (a *Application) slackText(res *result) string {
+	var b strings.Builder
+	if res.DryRun {
+		b.WriteString("*[DRY RUN]* ")
+	}
+	if res.Partial() {
+		fmt.Fprintf(&b, ":warning: %s of %s has *partially succeeded*\n", res.Operation(), a.resourceNames(", "))
+	} else if res.Status() == statusWarning {
+		fmt.Fprintf(&b, ":warning: %s of %s has *succeeded with warnings*\n", res.Operation(), a.resourceNames(", "))
+	} else if res.Success {
+		fmt.Fprintf(&b, ":white_check_mark: %s of %s has *succeeded*\n", res.Operation(), a.resourceNames(", "))
+	} else {
+		fmt.Fprintf(&b, ":x: %s of %s has *failed*\n", res.Operation(), a.resourceNames(", "))
+	}
+
+	for _, line := range res.summary() {
+		b.WriteString(slackEscaper.Replace(line))
+		b.WriteByte('\n')
+	}
+
+	if len(res.Warnings) != 0 {
+		b.WriteString("Warnings:\n")
+		for _, warning := range res.Warnings {
+			fmt.Fprintf(&b, "• %s\n", slackEscaper.Replace(warning))
+		}
+	}
+
+	if res.DownloadURL != "" {
+		fmt.Fprintf(&b, "<%s|Download>\n", slackEscaper.Replace(res.DownloadURL))
+	}
+
+	b.WriteString("\nLog output was:\n```")
+	// Error messages may contain XML or HTML, e.g. S3 error responses.
+	b.WriteString(slackEscaper.Replace(a.logData.String()))
+	b.WriteString("```")
+
+	return b.String()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSlackTextEscaping(t *testing.T) {
+	tests := []struct {
+		name     string
+		warning  string
+		log      string
+		want     string
+		unwanted string
+	}{
+		{
+			name:     "S3 error in log",
+			log:      "ERRO Failed to upload error=\"<Error><Code>AccessDenied</Code></Error>\"\n",
+			want:     "&lt;Error&gt;&lt;Code&gt;AccessDenied&lt;/Code&gt;&lt;/Error&gt;",
+			unwanted: "<Error>",
+		},
+		{
+			name:     "ampersand in log",
+			log:      "ERRO Failed to push metrics error=\"GET /metrics?a=1&b=2\"\n",
+			want:     "a=1&amp;b=2",
+			unwanted: "a=1&b=2",
+		},
+		{
+			name:     "warning",
+			warning:  "Failed to prune old archives error=\"<html>Bad Gateway & retry</html>\"",
+			want:     "&lt;html&gt;Bad Gateway &amp; retry&lt;/html&gt;",
+			unwanted: "<html>",
+		},
+		{
+			name:     "already escaped",
+			log:      "error=\"&lt;\"\n",
+			want:     "&amp;lt;",
+			unwanted: "error=\"&lt;\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Application{
+				logData:   bytes.NewBufferString(tt.log),
+				resources: []resource{parseResource("deployment/db")},
+			}
+			if tt.warning != "" {
+				a.warnings = append(a.warnings, tt.warning)
+			}
+
+			text := a.slackText(a.result(nil))
+			if !strings.Contains(text, tt.want) {
+				t.Errorf("text doesn't contain %q:\n%s", tt.want, text)
+			}
+			if strings.Contains(text, tt.unwanted) {
+				t.Errorf("text contains %q:\n%s", tt.unwanted, text)
+			}
+		})
+	}
+}
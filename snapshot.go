@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var volumeSnapshotResource = schema.GroupVersionResource{
+	Group:    "snapshot.storage.k8s.io",
+	Version:  "v1",
+	Resource: "volumesnapshots",
+}
+
+var errSnapshotNotReady = errors.New("timed out waiting for snapshot to become ready")
+
+type objectForSnapshot struct {
+	Status struct {
+		ReadyToUse *bool `json:"readyToUse"`
+		Error      *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	} `json:"status"`
+}
+
+// snapshotName returns the name of the VolumeSnapshot of the PVC,
+// which is unique for each run.
+func (a *Application) snapshotName() string {
+	return a.config.Snapshot.PVC + "-" + a.startTime.UTC().Format("20060102-150405")
+}
+
+// snapshot creates a VolumeSnapshot of the PVC and waits for it to become ready to use.
+func (a *Application) snapshot(ctx context.Context) (err error) {
+	lg := log.FromContext(ctx)
+
+	name := a.snapshotName()
+	if a.config.DryRun {
+		lg.Info("Dry run: skipping creation of volume snapshot", "name", name)
+		return nil
+	}
+
+	obj := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": volumeSnapshotResource.GroupVersion().String(),
+		"kind":       "VolumeSnapshot",
+		"metadata": map[string]any{
+			"name":      name,
+			"namespace": a.config.Resource.Namespace,
+		},
+		"spec": map[string]any{
+			"source": map[string]any{
+				"persistentVolumeClaimName": a.config.Snapshot.PVC,
+			},
+		},
+	}}
+	if a.config.Snapshot.Class != "" {
+		if err := unstructured.SetNestedField(obj.Object, a.config.Snapshot.Class, "spec", "volumeSnapshotClassName"); err != nil {
+			return fmt.Errorf("failed to set snapshot class: %w", err)
+		}
+	}
+
+	snapshots := a.dynamicClient.Resource(volumeSnapshotResource).Namespace(a.config.Resource.Namespace)
+
+	lg.Info("Trying to create volume snapshot", "name", name)
+	err = a.retryK8s(ctx, func() (err error) {
+		_, err = snapshots.Create(ctx, obj, metav1.CreateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create volume snapshot: %w", err)
+	}
+	a.snapshotID = a.config.Resource.Namespace + "/" + name
+
+	lg.Info("Waiting for volume snapshot to become ready", "name", name)
+
+	err = a.pollTimeout(ctx, time.Duration(a.config.Snapshot.Timeout), errSnapshotNotReady, func(ctx context.Context) (bool, error) {
+		return a.snapshotReady(ctx, name)
+	})
+	if err != nil {
+		return err
+	}
+
+	lg.Info("Volume snapshot is ready", "name", name)
+
+	return nil
+}
+
+func (a *Application) snapshotReady(ctx context.Context, name string) (ready bool, err error) {
+	obj, err := a.dynamicClient.
+		Resource(volumeSnapshotResource).
+		Namespace(a.config.Resource.Namespace).
+		Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to get volume snapshot: %w", err)
+	}
+
+	var snapshot objectForSnapshot
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &snapshot); err != nil {
+		return false, fmt.Errorf("failed to convert volume snapshot: %w", err)
+	}
+
+	if e := snapshot.Status.Error; e != nil && e.Message != "" {
+		return false, fmt.Errorf("volume snapshot failed: %s", e.Message)
+	}
+
+	return snapshot.Status.ReadyToUse != nil && *snapshot.Status.ReadyToUse, nil
+}
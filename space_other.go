@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// freeSpace reports that free space can't be determined on this platform.
+func freeSpace(dir string) (free int64, err error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// extent is a region of a file containing data.
+type extent struct {
+	offset int64
+	length int64
+}
+
+// isSparse reports whether the extents don't cover the whole file.
+func isSparse(extents []extent, size int64) bool {
+	var total int64
+	for _, e := range extents {
+		total += e.length
+	}
+	return total < size
+}
+
+// PAX records marking an entry stored in the PAX 1.0 sparse format.
+const (
+	paxGNUSparseMajor = "GNU.sparse.major"
+	paxGNUSparseMinor = "GNU.sparse.minor"
+)
+
+// writeSparseFile writes the file to the tar stream in the PAX 1.0 sparse format,
+// storing only its data extents.
+// archive/tar can read this format, but can't write it,
+// so the entry is written directly to w, which must be the writer underlying tw.
+func writeSparseFile(ctx context.Context, tw *tar.Writer, w io.Writer, header *tar.Header, file *os.File, extents []extent) (err error) {
+	// Pads the previous entry, so that w is at the block boundary.
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	// GNU tar needs an empty extent at the end to restore the trailing hole.
+	if n := len(extents); n == 0 || extents[n-1].offset+extents[n-1].length < header.Size {
+		extents = append(extents, extent{offset: header.Size, length: 0})
+	}
+
+	var sparseMap strings.Builder
+	fmt.Fprintf(&sparseMap, "%d\n", len(extents))
+	for _, e := range extents {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", e.offset, e.length)
+	}
+	sparseMap.Write(zeroBlock[:blockPadding(int64(sparseMap.Len()))])
+
+	size := int64(sparseMap.Len())
+	for _, e := range extents {
+		size += e.length
+	}
+
+	var records strings.Builder
+	records.WriteString(paxRecord(paxGNUSparseMajor, "1"))
+	records.WriteString(paxRecord(paxGNUSparseMinor, "0"))
+	records.WriteString(paxRecord("GNU.sparse.name", header.Name))
+	records.WriteString(paxRecord("GNU.sparse.realsize", strconv.FormatInt(header.Size, 10)))
+	records.WriteString(paxRecord("size", strconv.FormatInt(size, 10)))
+	records.WriteString(paxRecord("mtime", strconv.FormatInt(header.ModTime.Unix(), 10)))
+	records.WriteString(paxRecord("uid", strconv.Itoa(header.Uid)))
+	records.WriteString(paxRecord("gid", strconv.Itoa(header.Gid)))
+	if header.Uname != "" {
+		records.WriteString(paxRecord("uname", header.Uname))
+	}
+	if header.Gname != "" {
+		records.WriteString(paxRecord("gname", header.Gname))
+	}
+	recordsSize := int64(records.Len())
+	records.Write(zeroBlock[:blockPadding(recordsSize)])
+
+	dir, base := path.Split(header.Name)
+	paxHeader := ustarHeader(path.Join(dir, "PaxHeaders.0", base), tar.TypeXHeader, recordsSize, header)
+	fileHeader := ustarHeader(path.Join(dir, "GNUSparseFile.0", base), tar.TypeReg, size, header)
+
+	for _, b := range [][]byte{paxHeader, []byte(records.String()), fileHeader, []byte(sparseMap.String())} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range extents {
+		if _, err := io.CopyN(w, &contextReader{ctx: ctx, r: io.NewSectionReader(file, e.offset, e.length)}, e.length); err != nil {
+			return err
+		}
+	}
+
+	_, err = w.Write(zeroBlock[:blockPadding(size)])
+	return err
+}
+
+const blockSize = 512
+
+var zeroBlock [blockSize]byte
+
+// blockPadding returns the number of bytes needed to pad n to the block size.
+func blockPadding(n int64) int {
+	return int(-n & (blockSize - 1))
+}
+
+// paxRecord formats a PAX record, which is prefixed with its own length.
+func paxRecord(k, v string) string {
+	const padding = 3 // ' ', '=' and '\n'
+	size := len(k) + len(v) + padding
+	size += len(strconv.Itoa(size))
+	record := strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	// The length might have gained a digit.
+	if len(record) != size {
+		size = len(record)
+		record = strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	}
+	return record
+}
+
+// ustarHeader returns the USTAR header block.
+// Values that don't fit are truncated, since readers take them from the PAX records.
+func ustarHeader(name string, typeflag byte, size int64, header *tar.Header) []byte {
+	block := make([]byte, blockSize)
+
+	putString := func(b []byte, s string) {
+		copy(b[:len(b)-1], s)
+	}
+	putOctal := func(b []byte, n int64) {
+		s := fmt.Sprintf("%0*o", len(b)-1, n)
+		if n < 0 || len(s) > len(b)-1 {
+			s = fmt.Sprintf("%0*o", len(b)-1, 0)
+		}
+		copy(b, s)
+	}
+
+	putString(block[0:100], name)
+	putOctal(block[100:108], header.Mode&0o7777)
+	putOctal(block[108:116], int64(header.Uid))
+	putOctal(block[116:124], int64(header.Gid))
+	putOctal(block[124:136], size)
+	putOctal(block[136:148], header.ModTime.Unix())
+	block[156] = typeflag
+	copy(block[257:263], "ustar\x00")
+	copy(block[263:265], "00")
+	putString(block[265:297], header.Uname)
+	putString(block[297:329], header.Gname)
+
+	// The checksum is calculated with the checksum field filled with spaces.
+	copy(block[148:156], "        ")
+	var sum int64
+	for _, c := range block {
+		sum += int64(c)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+	return block
+}
+
+// holeWriter writes to the file, seeking over zero chunks instead of writing them,
+// so that they become holes. The file must be truncated to its size afterwards,
+// in case it ends with a hole.
+type holeWriter struct {
+	file *os.File
+}
+
+func (w *holeWriter) Write(b []byte) (n int, err error) {
+	for _, c := range b {
+		if c != 0 {
+			return w.file.Write(b)
+		}
+	}
+	if _, err := w.file.Seek(int64(len(b)), io.SeekCurrent); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileExtents returns data extents of the file using SEEK_DATA and SEEK_HOLE.
+// File systems that don't support them report the whole file as data.
+func fileExtents(file *os.File, size int64) (extents []extent, err error) {
+	var offset int64
+	for offset < size {
+		data, err := file.Seek(offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// No data past the offset.
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		hole, err := file.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+
+		extents = append(extents, extent{offset: data, length: hole - data})
+		offset = hole
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return extents, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// fileExtents reports the whole file as data,
+// since holes can't be detected on this platform.
+func fileExtents(file *os.File, size int64) (extents []extent, err error) {
+	return []extent{{offset: 0, length: size}}, nil
+}
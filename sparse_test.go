@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSparseFileRoundTrip(t *testing.T) {
+	const holeSize = 8 << 20
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "disk.img")
+
+	// Data, a hole and data again, followed by a trailing hole.
+	head := bytes.Repeat([]byte("a"), 4096)
+	tail := bytes.Repeat([]byte("b"), 4096)
+	size := int64(len(head) + holeSize + len(tail) + holeSize)
+
+	file, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteAt(head, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt(tail, int64(len(head)+holeSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+
+	extents, err := fileExtents(file, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSparse(extents, size) {
+		t.Skip("file system doesn't report holes")
+	}
+
+	a := &Application{health: newHealth(time.Minute)}
+	a.config.Backup.Directories = []string{dir}
+	a.config.Backup.Sparse = true
+
+	archive, err := os.Create(filepath.Join(t.TempDir(), "backup.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	if err := a.writeArchive(context.Background(), archive); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the data extents are stored.
+	info, err := archive.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 64<<10 {
+		t.Fatalf("archive of %d bytes", info.Size())
+	}
+
+	restoreDir := t.TempDir()
+	if err := newTestRestore(restoreDir, archive).extract(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := os.ReadFile(filepath.Join(restoreDir, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(restored)) != size {
+		t.Fatalf("restored %d bytes, want %d", len(restored), size)
+	}
+
+	want := make([]byte, size)
+	copy(want, head)
+	copy(want[len(head)+holeSize:], tail)
+	if !bytes.Equal(restored, want) {
+		t.Fatal("restored content differs")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// PAX record marking entries with the output of BACKUP_STREAM_ENTRY commands,
+// so that restore can tell them apart from files with the same name.
+const streamEntryPAXRecord = "K8SBACKUP.stream"
+
+// writeStreamEntries runs the stream entry commands and adds their output to the root of the archive.
+// Entries are added in the order of their names, so that archives are reproducible.
+func (a *Application) writeStreamEntries(ctx context.Context, tw *tar.Writer, stats *archiveStats) (err error) {
+	for _, name := range slices.Sorted(maps.Keys(a.config.Backup.StreamEntries)) {
+		if err := a.writeStreamEntry(ctx, tw, name, a.config.Backup.StreamEntries[name]); err != nil {
+			return fmt.Errorf("failed to archive stream entry %s: %w", name, err)
+		}
+		stats.entries++
+	}
+	return nil
+}
+
+// writeStreamEntry runs the command with sh -c locally and adds its stdout to the archive as the entry.
+// The output is spooled into the temporary directory first,
+// since the size of a tar entry must be known before its content is written.
+func (a *Application) writeStreamEntry(ctx context.Context, tw *tar.Writer, name, command string) (err error) {
+	lg := log.FromContext(ctx).With("entry", name)
+	lg.Info("Trying to run stream entry command", "command", command)
+
+	file, err := os.CreateTemp(a.config.Backup.TempDirectory(), ".k8s-backup-entry-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdout = file
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+
+	if stderr.Len() != 0 {
+		lg.Info("Command stderr", "output", strings.TrimRight(stderr.String(), "\n"))
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to run command: %w", err)
+	}
+
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to seek temporary file: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek temporary file: %w", err)
+	}
+
+	header := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       name,
+		Size:       size,
+		Mode:       0o600,
+		ModTime:    time.Now(),
+		PAXRecords: map[string]string{streamEntryPAXRecord: "true"},
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(tw, &contextReader{ctx: ctx, r: file}); err != nil {
+		return err
+	}
+
+	lg.Info("Successfuly added stream entry", "size", byteCountIEC(size))
+
+	return nil
+}
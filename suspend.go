@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/charmbracelet/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// DaemonSets can't be scaled, so in order to stop their pods
+// we add a node selector that doesn't match any node.
+const suspendNodeSelectorKey = "k8s-backup/suspended"
+
+type (
+	objectForNodeSelector struct {
+		NodeSelector map[string]*string `json:"nodeSelector"`
+	}
+
+	objectForTemplateSpec struct {
+		Spec objectForNodeSelector `json:"spec"`
+	}
+
+	objectForTemplate struct {
+		Template objectForTemplateSpec `json:"template"`
+	}
+
+	objectForDaemonSetSpec struct {
+		Spec objectForTemplate `json:"spec"`
+	}
+)
+
+func (a *Application) patchDaemonSet(ctx context.Context, res *resource, suspend bool) (err error) {
+	lg := log.FromContext(ctx)
+
+	if a.config.DryRun {
+		lg.Info("Dry run: skipping patching daemonset", "suspend", suspend)
+		return nil
+	}
+
+	lg.Info("Trying to patch daemonset", "suspend", suspend)
+
+	// Merge patch removes the key if its value is null.
+	var value *string
+	if suspend {
+		value = new(string)
+		*value = "true"
+	}
+
+	spec := objectForDaemonSetSpec{
+		Spec: objectForTemplate{
+			Template: objectForTemplateSpec{
+				Spec: objectForNodeSelector{
+					NodeSelector: map[string]*string{suspendNodeSelectorKey: value},
+				},
+			},
+		},
+	}
+
+	patch, err := json.Marshal(&spec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal patch: %w", err)
+	}
+
+	err = a.retryK8s(ctx, func() (err error) {
+		_, err = a.clientset.AppsV1().
+			DaemonSets(a.config.Resource.Namespace).
+			Patch(ctx, res.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to patch daemonset: %w", err)
+	}
+
+	lg.Info("Successfuly patched daemonset", "suspend", suspend)
+
+	return nil
+}
+
+func (a *Application) waitDaemonSet(ctx context.Context, res *resource) (err error) {
+	lg := log.FromContext(ctx)
+	lg.Info("Waiting for pods to terminate")
+
+	daemonsets := a.clientset.AppsV1().DaemonSets(a.config.Resource.Namespace)
+
+	err = a.poll(ctx, errPodsNotTerminated, func(ctx context.Context) (done bool, err error) {
+		ds, err := daemonsets.Get(ctx, res.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, fmt.Errorf("failed to get daemonset: %w", err)
+		}
+		return ds.Status.ObservedGeneration >= ds.Generation &&
+			ds.Status.CurrentNumberScheduled == 0 &&
+			ds.Status.NumberMisscheduled == 0, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	lg.Info("Pods have terminated")
+
+	return nil
+}
+
+func (a *Application) suspendDaemonSet(ctx context.Context, res *resource) (undo func(context.Context) error, err error) {
+	if err := a.patchDaemonSet(ctx, res, true); err != nil {
+		return nil, fmt.Errorf("failed to suspend daemonset: %w", err)
+	}
+
+	undo = func(ctx context.Context) error {
+		ctx = log.WithContext(ctx, log.FromContext(ctx).With("resource", res.ID))
+		err := a.retryScaleUp(ctx, func(ctx context.Context, attempt int) error {
+			if attempt != 0 {
+				ds, err := a.clientset.AppsV1().
+					DaemonSets(a.config.Resource.Namespace).
+					Get(ctx, res.Name, metav1.GetOptions{})
+				if err != nil {
+					return fmt.Errorf("failed to get daemonset: %w", err)
+				}
+				if _, ok := ds.Spec.Template.Spec.NodeSelector[suspendNodeSelectorKey]; !ok {
+					a.warn(log.FromContext(ctx), "Daemonset has been resumed by someone else, skipping")
+					return nil
+				}
+			}
+			return a.patchDaemonSet(ctx, res, false)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to resume %s: %w", res.ID, err)
+		}
+		return nil
+	}
+
+	return undo, nil
+}
+
+type (
+	objectForSuspend struct {
+		Suspend bool `json:"suspend"`
+	}
+
+	objectForCronJobSpec struct {
+		Spec objectForSuspend `json:"spec"`
+	}
+)
+
+func (a *Application) patchCronJob(ctx context.Context, res *resource, suspend bool) (err error) {
+	lg := log.FromContext(ctx)
+
+	if a.config.DryRun {
+		lg.Info("Dry run: skipping patching cronjob", "suspend", suspend)
+		return nil
+	}
+
+	lg.Info("Trying to patch cronjob", "suspend", suspend)
+
+	spec := objectForCronJobSpec{
+		Spec: objectForSuspend{Suspend: suspend},
+	}
+
+	patch, err := json.Marshal(&spec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal patch: %w", err)
+	}
+
+	err = a.retryK8s(ctx, func() (err error) {
+		_, err = a.clientset.BatchV1().
+			CronJobs(a.config.Resource.Namespace).
+			Patch(ctx, res.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to patch cronjob: %w", err)
+	}
+
+	lg.Info("Successfuly patched cronjob", "suspend", suspend)
+
+	return nil
+}
+
+var errJobsNotFinished = errors.New("active jobs did not finish in time")
+
+func (a *Application) waitCronJob(ctx context.Context, res *resource) (err error) {
+	lg := log.FromContext(ctx)
+	lg.Info("Waiting for active jobs to finish")
+
+	cronjobs := a.clientset.BatchV1().CronJobs(a.config.Resource.Namespace)
+
+	err = a.poll(ctx, errJobsNotFinished, func(ctx context.Context) (done bool, err error) {
+		cj, err := cronjobs.Get(ctx, res.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, fmt.Errorf("failed to get cronjob: %w", err)
+		}
+		return len(cj.Status.Active) == 0, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	lg.Info("Active jobs have finished")
+
+	return nil
+}
+
+func (a *Application) suspendCronJob(ctx context.Context, res *resource) (undo func(context.Context) error, err error) {
+	lg := log.FromContext(ctx)
+	lg.Info("Trying to get cronjob")
+
+	cj, err := a.clientset.BatchV1().
+		CronJobs(a.config.Resource.Namespace).
+		Get(ctx, res.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cronjob: %w", err)
+	}
+
+	suspended := cj.Spec.Suspend != nil && *cj.Spec.Suspend
+	lg.Info("Got cronjob", "suspended", suspended)
+
+	if !suspended {
+		if err := a.patchCronJob(ctx, res, true); err != nil {
+			return nil, fmt.Errorf("failed to suspend cronjob: %w", err)
+		}
+	}
+
+	undo = func(ctx context.Context) error {
+		if suspended {
+			return nil
+		}
+		ctx = log.WithContext(ctx, log.FromContext(ctx).With("resource", res.ID))
+		err := a.retryScaleUp(ctx, func(ctx context.Context, attempt int) error {
+			if attempt != 0 {
+				cj, err := a.clientset.BatchV1().
+					CronJobs(a.config.Resource.Namespace).
+					Get(ctx, res.Name, metav1.GetOptions{})
+				if err != nil {
+					return fmt.Errorf("failed to get cronjob: %w", err)
+				}
+				if cj.Spec.Suspend == nil || !*cj.Spec.Suspend {
+					a.warn(log.FromContext(ctx), "Cronjob has been resumed by someone else, skipping")
+					return nil
+				}
+			}
+			return a.patchCronJob(ctx, res, false)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to resume %s: %w", res.ID, err)
+		}
+		return nil
+	}
+
+	return undo, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"html"
+	"strings"
+)
+
+// telegramFormat formats messages for one of the Telegram parse modes.
+type telegramFormat struct {
+	parseMode string // as expected by the Bot API, empty for plain text
+	escape    func(s string) string
+	bold      func(s string) string
+	pre       func(s string) string
+	link      func(text, url string) string
+}
+
+// Characters which must be escaped in MarkdownV2 text.
+var markdownV2Escaper = strings.NewReplacer(
+	`_`, `\_`, `*`, `\*`, `[`, `\[`, `]`, `\]`, `(`, `\(`, `)`, `\)`,
+	`~`, `\~`, "`", "\\`", `>`, `\>`, `#`, `\#`, `+`, `\+`, `-`, `\-`,
+	`=`, `\=`, `|`, `\|`, `{`, `\{`, `}`, `\}`, `.`, `\.`, `!`, `\!`,
+	`\`, `\\`,
+)
+
+// Characters which must be escaped inside MarkdownV2 pre blocks and link URLs.
+var markdownV2CodeEscaper = strings.NewReplacer("`", "\\`", `\`, `\\`, `)`, `\)`)
+
+// newTelegramFormat returns the format of TELEGRAM_PARSE_MODE.
+func newTelegramFormat(parseMode string) *telegramFormat {
+	switch parseMode {
+	case "MarkdownV2":
+		return &telegramFormat{
+			parseMode: "MarkdownV2",
+			escape:    markdownV2Escaper.Replace,
+			bold: func(s string) string {
+				return "*" + s + "*"
+			},
+			pre: func(s string) string {
+				return "```\n" + markdownV2CodeEscaper.Replace(s) + "\n```"
+			},
+			link: func(text, url string) string {
+				return "[" + markdownV2Escaper.Replace(text) + "](" + markdownV2CodeEscaper.Replace(url) + ")"
+			},
+		}
+	case "none":
+		return &telegramFormat{
+			escape: func(s string) string { return s },
+			bold:   func(s string) string { return s },
+			pre:    func(s string) string { return s },
+			link: func(text, url string) string {
+				return text + ": " + url
+			},
+		}
+	default:
+		return &telegramFormat{
+			parseMode: "HTML",
+			escape:    html.EscapeString,
+			bold: func(s string) string {
+				return "<b>" + s + "</b>"
+			},
+			pre: func(s string) string {
+				return "<pre>" + html.EscapeString(s) + "</pre>"
+			},
+			link: func(text, url string) string {
+				return "<a href=\"" + html.EscapeString(url) + "\">" + html.EscapeString(text) + "</a>"
+			},
+		}
+	}
+}